@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Define the default time in milliseconds that a key must be held to be
+// shifted and how much the auto shift keys change it by.
+const (
+	defaultAutoShiftTimeout = 175
+	autoShiftStep           = 5
+)
+
+// Define auto shift, which types the shifted character of a key that is held
+// past the timeout, such as ! for 1. Groups name the keys that are shifted and
+// may be overridden by each device. Disabled is only set at runtime.
+type autoShiftConfig struct {
+	timeout  int
+	groups   []string
+	disabled bool
+}
+
+type autoShiftSpec struct {
+	Timeout *int     `json:"timeout"`
+	Groups  []string `json:"groups"`
+}
+
+// Define the groups of keys that auto shift applies to, taken from the keys
+// whose characters depend on the layout of the host.
+var autoShiftGroups = map[string][]uint8{
+	"letters": layoutCodes[:26],
+	"numbers": layoutCodes[26:36],
+	"symbols": layoutCodes[36:],
+}
+
+// Define a key that has been pressed but not yet resolved into its shifted or
+// unshifted character. Events that follow it are queued until it is resolved.
+type pendingAutoShift struct {
+	pos int
+	key desktopKey
+	at  time.Time
+}
+
+func parseAutoShift(spec autoShiftSpec) (autoShiftConfig, error) {
+	var errs errorList
+	a := autoShiftConfig{timeout: defaultAutoShiftTimeout, groups: spec.Groups}
+	if spec.Timeout != nil {
+		a.timeout = *spec.Timeout
+		if a.timeout <= 0 {
+			errs = append(errs, errors.New("auto shift timeout must be positive"))
+		}
+	}
+	if err := checkAutoShiftGroups(spec.Groups); err != nil {
+		errs = append(errs, fmt.Errorf("auto shift: %v", err))
+	}
+	if errs != nil {
+		return autoShiftConfig{}, errs
+	}
+	return a, nil
+}
+
+func checkAutoShiftGroups(groups []string) error {
+	for _, value := range groups {
+		if _, ok := autoShiftGroups[value]; !ok {
+			return fmt.Errorf("unknown group %q", value)
+		}
+	}
+	return nil
+}
+
+func (a autoShiftConfig) wait() time.Duration {
+	return time.Duration(a.timeout) * time.Millisecond
+}
+
+// Decide whether k is resolved by auto shift on the current device. Keys that
+// are already shifted and keys typed while Shift is held or during a leader
+// sequence are pressed as usual.
+func (s *state) autoShifts(k key) bool {
+	d, ok := k.(desktopKey)
+	if !ok || d.shift || autoShift.disabled || s.shifted() || s.sequence != nil {
+		return false
+	}
+	groups := autoShift.groups
+	if g := devices[s.device].autoShift; g != nil {
+		groups = g
+	}
+	for _, name := range groups {
+		for _, code := range autoShiftGroups[name] {
+			if code == d.code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Decide whether the pending auto shift key is shifted based on the queued
+// events and the current time. It is shifted if held past the timeout. Like
+// any other key, it is not shifted if it is released or another key is pressed
+// before then. Return false for ok if it cannot be decided yet.
+func (s *state) resolveAutoShift(now time.Time) (shift, ok bool) {
+	p := s.autoShift
+	deadline := p.at.Add(autoShift.wait())
+	for _, ev := range s.queue {
+		switch {
+		case !ev.at.Before(deadline):
+			return true, true
+		case ev.pos == p.pos, ev.down:
+			return false, true
+		}
+	}
+	if !now.Before(deadline) {
+		return true, true
+	}
+	return false, false
+}
+
+// Change the auto shift timeout until the keymap is reloaded. It does not go
+// below one step.
+func (s *state) adjustAutoShift(delta int) {
+	if autoShift.timeout += delta; autoShift.timeout < autoShiftStep {
+		autoShift.timeout = autoShiftStep
+	}
+	s.handleKey(0)
+}
+
+// Type the auto shift timeout in milliseconds.
+func (s *state) reportAutoShift() {
+	stringKey(strconv.Itoa(autoShift.timeout)).handle(s)
+}
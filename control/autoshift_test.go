@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+func TestAutoShift(t *testing.T) {
+	tests := []struct {
+		name     string
+		device   []string
+		disabled bool
+		delta    int
+		events   []testEvent
+		want     string
+	}{
+		{
+			name:   "tap",
+			events: []testEvent{press(0, 0), release(100, 0)},
+			want:   "+KC_1 -KC_1",
+		},
+		{
+			name:   "hold",
+			events: []testEvent{press(0, 0), tick(175), release(300, 0)},
+			want:   "+KC_LSHIFT +KC_1 -KC_1 -KC_LSHIFT",
+		},
+		{
+			name:   "released after timeout",
+			events: []testEvent{press(0, 0), release(200, 0)},
+			want:   "+KC_LSHIFT +KC_1 -KC_1 -KC_LSHIFT",
+		},
+		{
+			name:   "roll",
+			events: []testEvent{press(0, 0), press(50, 1), release(100, 0), release(150, 1)},
+			want:   "+KC_1 +KC_A -KC_1 -KC_A",
+		},
+		{
+			name:   "roll after hold",
+			events: []testEvent{press(0, 0), tick(175), press(200, 1), release(210, 0), release(220, 1)},
+			want:   "+KC_LSHIFT +KC_1 -KC_LSHIFT +KC_A -KC_1 -KC_A",
+		},
+		{
+			name:   "not in group",
+			events: []testEvent{press(0, 1), tick(200), release(300, 1)},
+			want:   "+KC_A -KC_A",
+		},
+		{
+			name:   "shift held",
+			events: []testEvent{press(0, 2), press(10, 0), release(20, 0), release(30, 2)},
+			want:   "+KC_LSHIFT +KC_1 -KC_1 -KC_LSHIFT",
+		},
+		{
+			name:   "off for device",
+			device: []string{},
+			events: []testEvent{press(0, 0), tick(200), release(300, 0)},
+			want:   "+KC_1 -KC_1",
+		},
+		{
+			name:     "disabled",
+			disabled: true,
+			events:   []testEvent{press(0, 0), tick(200), release(300, 0)},
+			want:     "+KC_1 -KC_1",
+		},
+		{
+			name:   "longer timeout",
+			delta:  50,
+			events: []testEvent{press(0, 0), release(200, 0)},
+			want:   "+KC_1 -KC_1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, log := newTestState(layer{kc1, kcALower, kcLShift})
+			autoShift.groups = []string{"numbers"}
+			autoShift.disabled = tt.disabled
+			if tt.device != nil {
+				devices["test"] = config{writer: devices["test"].writer, layout: hostLayouts["us"], autoShift: tt.device}
+			}
+			if tt.delta != 0 {
+				s.adjustAutoShift(tt.delta)
+			}
+			if got := runEvents(s, log, tt.events); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
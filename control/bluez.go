@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"os/exec"
+	"sync"
 	"text/template"
 	"time"
 
@@ -14,8 +15,12 @@ import (
 )
 
 // Create map for determining whether a MAC address is authorized and getting
-// its corresponding channel.
-var blChan = make(map[string]chan []byte)
+// its corresponding channel. The map is guarded by blMutex since devices may be
+// added or removed while connections are being accepted.
+var (
+	blChan  = make(map[string]chan []byte)
+	blMutex sync.Mutex
+)
 
 // Define channel for user to reset all temporary Bluetooth connections.
 var tmpChan = make(chan bool)
@@ -42,10 +47,25 @@ func (w blueZWriter) Write(p []byte) (int, error) {
 
 func newBlueZWriter(mac string) *hidWriter {
 	c := make(chan []byte)
+	blMutex.Lock()
 	blChan[mac] = c
+	blMutex.Unlock()
 	return newHIDWriter(blueZWriter(c))
 }
 
+func removeBlueZWriter(mac string) {
+	blMutex.Lock()
+	delete(blChan, mac)
+	blMutex.Unlock()
+}
+
+func getBlueZChan(mac string) (chan []byte, bool) {
+	blMutex.Lock()
+	defer blMutex.Unlock()
+	c, ok := blChan[mac]
+	return c, ok
+}
+
 func formatMAC(addr [6]uint8) string {
 	var data [6]byte
 	for key, value := range addr {
@@ -114,7 +134,7 @@ func listenL2CAP(psm uint16, h func(int, chan []byte)) error {
 				defer unix.Close(nfd)
 
 				// Handle connection directly if MAC address is recognized.
-				if c, ok := blChan[addr]; ok {
+				if c, ok := getBlueZChan(addr); ok {
 					h(nfd, c)
 					return
 				}
@@ -131,9 +151,14 @@ func listenL2CAP(psm uint16, h func(int, chan []byte)) error {
 
 				// Handle with the channel for temporary connections, which uses
 				// an empty string as the MAC address for the blChan map key.
+				// Return if no temporary device is configured.
+				c, ok := getBlueZChan("")
+				if !ok {
+					return
+				}
 				ctx, cancel := context.WithCancel(context.Background())
 				go func() {
-					h(nfd, blChan[""])
+					h(nfd, c)
 					cancel()
 				}()
 
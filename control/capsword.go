@@ -0,0 +1,49 @@
+package main
+
+// #include "keycode.h"
+import "C"
+
+import "unicode"
+
+// Toggle caps word. While it is on, letters are shifted and - is typed as _
+// until a key that ends the word, without using Caps Lock on the host.
+func (k capsWordKey) handle(s *state) {
+	s.capsWord = !s.capsWord
+	s.handleKey(0)
+}
+
+// Get the key to press in place of k if caps word is on. Letters and - are
+// shifted. Digits, Backspace, Delete, Shift, and layer keys keep the word going
+// and any other key ends it.
+func (s *state) applyCapsWord(k key) key {
+	if !s.capsWord {
+		return k
+	}
+	switch k := k.(type) {
+	case desktopKey:
+		switch code := k.code; {
+		case code >= C.KC_A && code <= C.KC_Z, code == C.KC_MINUS:
+			k.shift = true
+			return k
+		case code >= C.KC_1 && code <= C.KC_0 && !s.shifted(),
+			code == C.KC_BSPACE, code == C.KC_DELETE,
+			code == C.KC_LSHIFT, code == C.KC_RSHIFT:
+			return k
+		}
+	case virtualKey:
+		// Keep going for shifted letters and _.
+		if len(k) == 2 && k[0] == kcLShift {
+			if d, ok := k[1].(desktopKey); ok && (d.code >= C.KC_A && d.code <= C.KC_Z || d.code == C.KC_MINUS) {
+				return k
+			}
+		}
+	case composeKey:
+		if unicode.IsLetter(rune(k)) {
+			return composeKey(unicode.ToUpper(rune(k)))
+		}
+	case layerKey, capsWordKey:
+		return k
+	}
+	s.capsWord = false
+	return k
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestCapsWord(t *testing.T) {
+	tap := func(at, pos int) []testEvent {
+		return []testEvent{press(at, pos), release(at+5, pos)}
+	}
+	tests := []struct {
+		name string
+		taps []int
+		want string
+	}{
+		{"letters", []int{0, 1, 2, 1}, "+KC_LSHIFT +KC_A -KC_A -KC_LSHIFT +KC_LSHIFT +KC_MINUS -KC_MINUS -KC_LSHIFT +KC_LSHIFT +KC_A -KC_A -KC_LSHIFT"},
+		{"digits", []int{0, 3, 1}, "+KC_1 -KC_1 +KC_LSHIFT +KC_A -KC_A -KC_LSHIFT"},
+		{"end of word", []int{0, 1, 4, 1}, "+KC_LSHIFT +KC_A -KC_A -KC_LSHIFT +KC_SPACE -KC_SPACE +KC_A -KC_A"},
+		{"off", []int{0, 0, 1}, "+KC_A -KC_A"},
+	}
+	for _, tt := range tests {
+		s, log := newTestState(layer{kcCapsWord, kcALower, kcMinus, kc1, kcSpace})
+		var events []testEvent
+		for i, pos := range tt.taps {
+			events = append(events, tap(10*i, pos)...)
+		}
+		if got := runEvents(s, log, events); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Call f for k and every key nested within it.
+func walkKey(k key, f func(key)) {
+	if k == nil {
+		return
+	}
+	f(k)
+	switch k := k.(type) {
+	case virtualKey:
+		for _, value := range k {
+			walkKey(value, f)
+		}
+	case intlKey:
+		walkKey(k.stdKey, f)
+		walkKey(k.macKey, f)
+	case unicodeCompoundKey:
+		for _, value := range k {
+			walkKey(value, f)
+		}
+	case tapHoldKey:
+		walkKey(k.tap, f)
+		walkKey(k.hold, f)
+	case tapDanceKey:
+		for _, value := range append(append([]key{}, k.taps...), k.holds...) {
+			walkKey(value, f)
+		}
+	}
+}
+
+// Call f for every key in the keymap, including nested keys, along with where
+// the key is defined.
+func walkKeymap(km *keymap, f func(where string, k key)) {
+	for i, value := range km.layers {
+		for j, k := range value {
+			walkKey(k, func(k key) {
+				f(fmt.Sprintf("layer %d, position %d", i, j), k)
+			})
+		}
+	}
+	for i, value := range km.combos {
+		for j, combo := range value {
+			walkKey(combo.key, func(k key) {
+				f(fmt.Sprintf("layer %d, combo %d", i, j), k)
+			})
+		}
+	}
+	for i, value := range km.overrides {
+		for j, o := range value {
+			walkKey(o.key, func(k key) {
+				f(fmt.Sprintf("layer %d, override %d", i, j), k)
+			})
+		}
+	}
+	for i, value := range km.leader.sequences {
+		walkKey(value.key, func(k key) {
+			f(fmt.Sprintf("leader sequence %d", i), k)
+		})
+	}
+}
+
+// Verify that every layer matches the geometry, that every layerKey refers to
+// an existing layer, and that every switchKey refers to a configured device.
+// These would otherwise fail while handling keys. Keys that devices override
+// are verified against the layers of the device.
+func checkKeymap(km *keymap, c configFile) error {
+	var errs errorList
+	check := func(where string, k key, n int) {
+		switch k := k.(type) {
+		case layerKey:
+			if k.layer < 0 || k.layer >= n {
+				errs = append(errs, fmt.Errorf("%s: layer %d is not defined", where, k.layer))
+			}
+		case switchKey:
+			if _, ok := c.Devices[string(k)]; !ok {
+				errs = append(errs, fmt.Errorf("%s: device %q is not defined", where, k))
+			}
+		}
+	}
+	for key, value := range km.layers {
+		if n := c.Geometry.size(); len(value) != n {
+			errs = append(errs, fmt.Errorf("layer %d: %d positions, expected %d", key, len(value), n))
+		}
+	}
+	walkKeymap(km, func(where string, k key) {
+		check(where, k, len(km.layers))
+	})
+
+	names := make([]string, 0, len(km.devices))
+	for name := range km.devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l := km.devices[name]
+		for i, value := range l {
+			if n := c.Geometry.size(); len(value) != n && (i >= len(km.layers) || len(km.layers[i]) != len(value)) {
+				errs = append(errs, fmt.Errorf("device %s, layer %d: %d positions, expected %d", name, i, len(value), n))
+			}
+			for j, k := range value {
+				if i < len(km.layers) && j < len(km.layers[i]) && reflect.DeepEqual(k, km.layers[i][j]) {
+					continue
+				}
+				walkKey(k, func(k key) {
+					check(fmt.Sprintf("device %s, layer %d, position %d", name, i, j), k, len(l))
+				})
+			}
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// Find problems in the keymap that do not prevent it from being used but are
+// almost certainly mistakes. String, Unicode, and compose keys are checked
+// against the layers of every device in c.
+func lintKeymap(km *keymap, c configFile) errorList {
+	var errs errorList
+	l := km.layers
+	names := make([]string, 0, len(c.Devices))
+	for name := range c.Devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Find layers that cannot be reached from the default layer, including
+	// through combos, key overrides, and leader sequences.
+	reached := make([]bool, len(l))
+	reached[0] = true
+	for queue := []int{0}; len(queue) > 0; queue = queue[1:] {
+		keys := append(layer{}, l[queue[0]]...)
+		for _, value := range km.leader.sequences {
+			keys = append(keys, value.key)
+		}
+		if queue[0] < len(km.combos) {
+			for _, value := range km.combos[queue[0]] {
+				keys = append(keys, value.key)
+			}
+		}
+		if queue[0] < len(km.overrides) {
+			for _, value := range km.overrides[queue[0]] {
+				keys = append(keys, value.key)
+			}
+		}
+		for _, k := range keys {
+			walkKey(k, func(k key) {
+				if k, ok := k.(layerKey); ok && k.layer >= 0 && k.layer < len(l) && !reached[k.layer] {
+					reached[k.layer] = true
+					queue = append(queue, k.layer)
+				}
+			})
+		}
+	}
+	for key, value := range reached {
+		if !value {
+			errs = append(errs, fmt.Errorf("layer %d: not reachable from layer 0", key))
+		}
+	}
+
+	// Characters that a device cannot type are dropped when handling keys,
+	// such as every Unicode key on Android, which has no Unicode method. Each
+	// device is checked against its own layers. Unicode keys are not reported
+	// for devices that set their method to none, which accepts that they do
+	// nothing there.
+	for _, name := range names {
+		d := c.Devices[name]
+		dc := config{layout: d.hostLayout(), unicode: d.unicodeMethod(), compose: d.composeMethod()}
+		dk := *km
+		dk.layers = km.deviceLayers(name)
+		walkKeymap(&dk, func(where string, k key) {
+			switch k := k.(type) {
+			case stringKey:
+				for _, r := range k.untypable(dc) {
+					errs = append(errs, fmt.Errorf("%s: string key cannot type %q on device %s", where, r, name))
+				}
+			case unicodeKey:
+				if d.Unicode != "none" && !dc.unicode.canInput(rune(k)) {
+					reason := "its unicode method cannot input it"
+					if dc.unicode == unicodeNone {
+						reason = "it has no unicode method"
+					}
+					errs = append(errs, fmt.Errorf("%s: unicode key cannot type %q on device %s since %s", where, rune(k), name, reason))
+				}
+			case composeKey:
+				if !dc.canType(rune(k)) {
+					errs = append(errs, fmt.Errorf("%s: compose key cannot type %q on device %s", where, rune(k), name))
+				}
+			}
+		})
+	}
+
+	return errs
+}
+
+// Load the keymap and the device configuration and report every problem found
+// without touching any hardware. Return the exit status for the process.
+func runCheck() int {
+	var errs errorList
+	km, err := loadKeymap(*keymapPath)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if km != nil {
+		if err == nil {
+			if err := km.applyDevices(c); err != nil {
+				errs = append(errs, err)
+			} else if err := checkKeymap(km, c); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		errs = append(errs, lintKeymap(km, c)...)
+	}
+
+	if errs == nil {
+		fmt.Println("ok")
+		return 0
+	}
+	for _, value := range strings.Split(errs.Error(), "\n") {
+		fmt.Fprintln(os.Stderr, value)
+	}
+	return 1
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+// Test that Unicode keys are reported for Android devices unless they set the
+// Unicode method to none.
+func TestLintUnicode(t *testing.T) {
+	km := &keymap{layers: []layer{{unicodeKey('é'), kcALower}}}
+	c := configFile{Devices: map[string]deviceSpec{
+		"android": {Platform: "android"},
+		"none":    {Platform: "android", Unicode: "none"},
+		"linux":   {Platform: "linux"},
+	}}
+	errs := lintKeymap(km, c)
+	want := `layer 0, position 0: unicode key cannot type 'é' on device android since it has no unicode method`
+	if len(errs) != 1 || errs[0].Error() != want {
+		t.Errorf("got %v, want %s", errs, want)
+	}
+}
+
+// Test that the default keymap and devices have no problems.
+func TestLintDefault(t *testing.T) {
+	km := defaultKeymap
+	if err := km.applyDevices(defaultConfig); err != nil {
+		t.Fatal(err)
+	}
+	if errs := lintKeymap(&km, defaultConfig); errs != nil {
+		t.Error(errs)
+	}
+}
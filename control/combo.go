@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Define the default combo term in milliseconds, which is how long after the
+// first position of a combo is pressed the remaining positions may be pressed.
+const defaultComboTerm = 30
+
+// Define a key that is pressed by pressing every position of the combo within
+// the combo term, regardless of which half each position is on. The keys at
+// those positions are not pressed if the combo is.
+type combo struct {
+	positions []int
+	key       key
+}
+
+type comboSpec struct {
+	Positions []int           `json:"positions"`
+	Key       json.RawMessage `json:"key"`
+}
+
+func parseCombo(spec comboSpec, n int) (combo, error) {
+	if len(spec.Positions) < 2 {
+		return combo{}, errors.New("combo requires at least 2 positions")
+	}
+	seen := make(map[int]bool)
+	for _, value := range spec.Positions {
+		if value < 0 || value >= n {
+			return combo{}, fmt.Errorf("position %d does not exist", value)
+		}
+		if seen[value] {
+			return combo{}, fmt.Errorf("position %d is repeated", value)
+		}
+		seen[value] = true
+	}
+	k, err := parseKey(spec.Key)
+	if err != nil {
+		return combo{}, err
+	}
+	if k == nil {
+		return combo{}, errors.New("combo requires key")
+	}
+	return combo{positions: spec.Positions, key: k}, nil
+}
+
+func comboTimeout() time.Duration {
+	return time.Duration(comboTerm) * time.Millisecond
+}
+
+func (c combo) has(pos int) bool {
+	for _, value := range c.positions {
+		if value == pos {
+			return true
+		}
+	}
+	return false
+}
+
+// List the combos on the highest active layer that contain every pending position
+// as well as pos.
+func (s *state) comboCandidates(pos int) []combo {
+	i := s.layer.top()
+	if i >= len(combos) {
+		return nil
+	}
+	var result []combo
+	for _, c := range combos[i] {
+		ok := c.has(pos)
+		for _, ev := range s.chord {
+			ok = ok && c.has(ev.pos)
+		}
+		if ok {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// Find the combo whose positions are exactly the pending positions.
+func (s *state) comboMatch() (combo, bool) {
+	if i := s.layer.top(); i < len(combos) {
+		for _, c := range combos[i] {
+			if len(c.positions) != len(s.chord) {
+				continue
+			}
+			ok := true
+			for _, ev := range s.chord {
+				ok = ok && c.has(ev.pos)
+			}
+			if ok {
+				return c, true
+			}
+		}
+	}
+	return combo{}, false
+}
+
+// Add queued presses to the pending chord while they may still complete a
+// combo. Press the combo once the chord matches one that no further press can
+// extend. Otherwise, once the chord cannot grow, press the matching combo or
+// return the chord to the queue so that its keys are handled as usual. Return
+// false if it cannot be decided yet.
+func (s *state) resolveCombo(now time.Time) bool {
+	deadline := s.chord[0].at.Add(comboTimeout())
+	for len(s.queue) > 0 {
+		ev := s.queue[0]
+		if !ev.down || !ev.at.Before(deadline) {
+			break
+		}
+		candidates := s.comboCandidates(ev.pos)
+		if len(candidates) == 0 {
+			break
+		}
+		s.queue = s.queue[1:]
+		s.chord = append(s.chord, ev)
+		if c, ok := s.comboMatch(); ok && len(candidates) == 1 {
+			s.pressCombo(c)
+			return true
+		}
+	}
+	if len(s.queue) == 0 && now.Before(deadline) {
+		return false
+	}
+
+	if c, ok := s.comboMatch(); ok {
+		s.pressCombo(c)
+		return true
+	}
+
+	// Handle the first key as usual and check the rest for other combos.
+	chord := s.chord
+	s.chord = nil
+	s.queue = append(append([]keyEvent{}, chord[1:]...), s.queue...)
+	s.pressPosition(chord[0])
+	return true
+}
+
+// Press the combo key for the pending chord. The key is released as soon as
+// any of its positions is released.
+func (s *state) pressCombo(c combo) {
+	chord := s.chord
+	s.chord, s.at = nil, chord[len(chord)-1].at
+	j := chord[0].pos
+	s.activateKey(j, c.key)
+	if release := s.held[j]; release != nil {
+		released := false
+		for _, ev := range chord {
+			s.held[ev.pos] = func() {
+				if !released {
+					released = true
+					release()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestCombo(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []testEvent
+		want   string
+	}{
+		{
+			name:   "combo",
+			events: []testEvent{press(0, 0), press(10, 1), release(50, 0), release(60, 1)},
+			want:   "+KC_ESCAPE -KC_ESCAPE",
+		},
+		{
+			name:   "combo in any order",
+			events: []testEvent{press(0, 1), press(10, 0), release(50, 1), release(60, 0)},
+			want:   "+KC_ESCAPE -KC_ESCAPE",
+		},
+		{
+			name:   "longer combo",
+			events: []testEvent{press(0, 0), press(5, 1), press(10, 2), release(50, 0), release(55, 1), release(60, 2)},
+			want:   "+KC_TAB -KC_TAB",
+		},
+		{
+			name:   "shorter combo at term",
+			events: []testEvent{press(0, 0), press(5, 1), tick(30), release(50, 0), release(60, 1)},
+			want:   "+KC_ESCAPE -KC_ESCAPE",
+		},
+		{
+			name:   "after term",
+			events: []testEvent{press(0, 0), press(40, 1), release(50, 0), release(60, 1)},
+			want:   "+KC_A +KC_B -KC_A -KC_B",
+		},
+		{
+			name:   "tap",
+			events: []testEvent{press(0, 0), release(10, 0)},
+			want:   "+KC_A -KC_A",
+		},
+		{
+			name:   "other key",
+			events: []testEvent{press(0, 0), press(10, 3), release(20, 0), release(30, 3)},
+			want:   "+KC_A +KC_D -KC_A -KC_D",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, log := newTestState(layer{kcALower, kcBLower, kcCLower, kcDLower})
+			combos = [][]combo{{
+				{positions: []int{0, 1}, key: kcEscape},
+				{positions: []int{0, 1, 2}, key: kcTab},
+			}}
+			if got := runEvents(s, log, tt.events); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
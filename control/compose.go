@@ -0,0 +1,186 @@
+package main
+
+import "unicode"
+
+type composeMethod int
+
+// Define how accented and other non-ASCII characters are composed on the host.
+const (
+	// Do not compose characters.
+	composeNone composeMethod = iota
+
+	// Use the AltGr keys and the dead keys of the US International layout,
+	// which is available on Android, Linux, and Windows.
+	composeIntl
+
+	// Use the Option keys and the Option dead keys of the default MacOS
+	// layouts.
+	composeMacOS
+
+	// Use the compose key of X11 and Wayland, which must be mapped to the
+	// Menu key with the compose:menu option.
+	composeLinux
+)
+
+var composeMethods = map[string]composeMethod{
+	"none":  composeNone,
+	"intl":  composeIntl,
+	"macos": composeMacOS,
+	"linux": composeLinux,
+}
+
+// Define the method used by each platform if the device does not set one.
+var platformCompose = map[platform]composeMethod{
+	platAndroid: composeIntl,
+	platLinux:   composeIntl,
+	platMacOS:   composeMacOS,
+	platWindows: composeIntl,
+}
+
+type accent int
+
+const (
+	accentAcute accent = iota
+	accentGrave
+	accentCircumflex
+	accentDiaeresis
+	accentTilde
+	accentCedilla
+	accentRing
+)
+
+// Define a character as an accent applied to an ASCII base character.
+type composition struct {
+	base   rune
+	accent accent
+}
+
+// Map accented characters to their compositions. Only lower case characters
+// are listed since upper case characters are composed from upper case base
+// characters.
+var compositions = map[rune]composition{
+	'á': {'a', accentAcute}, 'é': {'e', accentAcute}, 'í': {'i', accentAcute},
+	'ó': {'o', accentAcute}, 'ú': {'u', accentAcute}, 'ý': {'y', accentAcute},
+	'à': {'a', accentGrave}, 'è': {'e', accentGrave}, 'ì': {'i', accentGrave},
+	'ò': {'o', accentGrave}, 'ù': {'u', accentGrave},
+	'â': {'a', accentCircumflex}, 'ê': {'e', accentCircumflex}, 'î': {'i', accentCircumflex},
+	'ô': {'o', accentCircumflex}, 'û': {'u', accentCircumflex},
+	'ä': {'a', accentDiaeresis}, 'ë': {'e', accentDiaeresis}, 'ï': {'i', accentDiaeresis},
+	'ö': {'o', accentDiaeresis}, 'ü': {'u', accentDiaeresis}, 'ÿ': {'y', accentDiaeresis},
+	'ã': {'a', accentTilde}, 'ñ': {'n', accentTilde}, 'õ': {'o', accentTilde},
+	'ç': {'c', accentCedilla},
+	'å': {'a', accentRing},
+}
+
+// Define how a compose method types characters. Direct keys type a character
+// by themselves and take precedence. Dead keys are typed before the base
+// character of a composition to apply an accent.
+type composeTable struct {
+	direct map[rune]key
+	dead   map[accent]key
+}
+
+// Map each compose method to its table. Characters that a method cannot type
+// fall back to the Unicode method of the device.
+var composeTables = map[composeMethod]composeTable{
+	composeIntl: {
+		direct: map[rune]key{
+			'á': altGr('a'), 'Á': altGr('A'), 'é': altGr('e'), 'É': altGr('E'),
+			'í': altGr('i'), 'Í': altGr('I'), 'ó': altGr('o'), 'Ó': altGr('O'),
+			'ú': altGr('u'), 'Ú': altGr('U'), 'ä': altGr('q'), 'Ä': altGr('Q'),
+			'å': altGr('w'), 'Å': altGr('W'), 'ö': altGr('p'), 'Ö': altGr('P'),
+			'ü': altGr('y'), 'Ü': altGr('Y'), 'ñ': altGr('n'), 'Ñ': altGr('N'),
+			'æ': altGr('z'), 'Æ': altGr('Z'), 'ø': altGr('l'), 'Ø': altGr('L'),
+			'ç': altGr(','), 'Ç': altGr('<'), 'ß': altGr('s'),
+			'¡': altGr('1'), '¿': altGr('/'),
+		},
+		dead: map[accent]key{
+			accentAcute:      ascii('\''),
+			accentGrave:      ascii('`'),
+			accentCircumflex: ascii('^'),
+			accentDiaeresis:  ascii('"'),
+			accentTilde:      ascii('~'),
+		},
+	},
+	composeMacOS: {
+		direct: map[rune]key{
+			'ç': option('c'), 'Ç': option('C'), 'å': option('a'), 'Å': option('A'),
+			'æ': option('\''), 'Æ': option('"'), 'ø': option('o'), 'Ø': option('O'),
+			'œ': option('q'), 'Œ': option('Q'), 'ß': option('s'),
+			'¡': option('1'), '¿': option('?'),
+		},
+		dead: map[accent]key{
+			accentAcute:      option('e'),
+			accentGrave:      option('`'),
+			accentCircumflex: option('i'),
+			accentDiaeresis:  option('u'),
+			accentTilde:      option('n'),
+		},
+	},
+	composeLinux: {
+		direct: map[rune]key{
+			'æ': compose("ae"), 'Æ': compose("AE"), 'ø': compose("/o"), 'Ø': compose("/O"),
+			'œ': compose("oe"), 'Œ': compose("OE"), 'ß': compose("ss"),
+			'¡': compose("!!"), '¿': compose("??"),
+		},
+		dead: map[accent]key{
+			accentAcute:      compose("'"),
+			accentGrave:      compose("`"),
+			accentCircumflex: compose("^"),
+			accentDiaeresis:  compose("\""),
+			accentTilde:      compose("~"),
+			accentCedilla:    compose(","),
+			accentRing:       compose("o"),
+		},
+	},
+}
+
+func ascii(r rune) key {
+	return asciiTable[r-' ']
+}
+
+func altGr(r rune) key {
+	return virtualKey{kcRAlt, ascii(r)}
+}
+
+func option(r rune) key {
+	return virtualKey{kcLAlt, ascii(r)}
+}
+
+func compose(text string) key {
+	return virtualKey{kcApp, stringKey(text)}
+}
+
+// Find the keys that type r with method m, or nil if m cannot type r.
+func (m composeMethod) sequence(r rune) key {
+	t := composeTables[m]
+	if k := t.direct[r]; k != nil {
+		return k
+	}
+	c, ok := compositions[r]
+	if lower := unicode.ToLower(r); !ok && unicode.ToUpper(lower) == r {
+		c, ok = compositions[lower]
+		c.base = unicode.ToUpper(c.base)
+	}
+	if dead := t.dead[c.accent]; ok && dead != nil {
+		return virtualKey{dead, ascii(c.base)}
+	}
+	return nil
+}
+
+// Type the character with a key of the host layout if it has one, such as é on
+// an AZERTY host. Otherwise, use the compose method of the device, falling back
+// to its Unicode method.
+func (k composeKey) handle(s *state) {
+	d := devices[s.device]
+	r := rune(k)
+	s.recordAs(func() {
+		if h, ok := d.layout.keys[r]; ok {
+			s.typeHostKey(h)
+		} else if seq := d.compose.sequence(r); seq != nil {
+			seq.handle(s)
+		} else {
+			d.unicode.input(s, r)
+		}
+	}, macroEvent{Char: &r})
+}
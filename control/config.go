@@ -0,0 +1,959 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The keymap file is JSON of the form {"layers": [[...], ...]} where each layer
+// lists its keys in the same order as the compiled layers, with one key for
+// every position in the geometry. Tap-hold behavior may be set with "tapping"
+// in the same form as defaultTapping. Combos may be listed for each layer with
+// "combos", as in [[{"positions": [13, 14], "key": "kcEscape"}], ...], and
+// their term in milliseconds set with "comboTerm". Leader sequences may be
+// defined with "leader", as in {"timeout": 1000, "sequences": [{"keys":
+// ["KC_D", "KC_M"], "key": "kcDeviceMNO"}]}. Key overrides may be listed for
+// each layer with "overrides", as in [[{"mods": ["shift"], "trigger":
+// "KC_BSPACE", "key": "kcDelete", "platforms": ["linux"]}], ...], where mods are
+// ctrl, shift, alt, or gui and platforms is optional. Auto shift may be set
+// with "autoShift", as in {"timeout": 175, "groups": ["numbers", "symbols"]},
+// where groups are letters, numbers, or symbols. A key is one of the following,
+// with positions and layers numbered from 0:
+//
+//	null                                   transparent key
+//	"kcNone"                               key that does nothing
+//	"kcALower"                             key compiled into keymap.go
+//	{"desktop": "KC_F"}                    desktopKey
+//	{"consumer": 226}                      consumerKey
+//	{"layer": 1, "mode": "momentary"}      layerKey, mode is optional
+//	{"layer": 1, "osl": true}              layerKey with mode "osl"
+//	{"switch": "def123"}                   switchKey
+//	{"std": ..., "mac": ...}               intlKey
+//	{"unicode": "😀"}                      unicodeKey or unicodeCompoundKey
+//	{"compose": "é"}                       composeKey
+//	{"shortcut": "copy"}                   shortcutKey
+//	{"string": "text"}                     stringKey
+//	{"virtual": [...]}                     virtualKey
+//	{"tap": ..., "hold": ...}              tapHoldKey
+//	{"taps": [...], "holds": [...]}        tapDanceKey, holds is optional
+//	{"macro": "record", "slot": 0}         macroKey, slot is optional
+type keymapFile struct {
+	Layers    [][]json.RawMessage `json:"layers"`
+	Tapping   *tappingConfig      `json:"tapping"`
+	Combos    [][]comboSpec       `json:"combos"`
+	ComboTerm *int                `json:"comboTerm"`
+	Leader    *leaderSpec         `json:"leader"`
+	Overrides [][]overrideSpec    `json:"overrides"`
+	AutoShift *autoShiftSpec      `json:"autoShift"`
+}
+
+// Define everything loaded from the keymap file.
+type keymap struct {
+	layers    []layer
+	tapping   tappingConfig
+	combos    [][]combo
+	comboTerm int
+	leader    leaderConfig
+	overrides [][]keyOverride
+	autoShift autoShiftConfig
+
+	// Map devices that override layers or positions to their layers.
+	devices map[string][]layer
+}
+
+var defaultKeymap = keymap{
+	layers:    defaultLayers,
+	tapping:   defaultTapping,
+	comboTerm: defaultComboTerm,
+	leader:    leaderConfig{timeout: defaultLeaderTimeout},
+	autoShift: autoShiftConfig{timeout: defaultAutoShiftTimeout},
+}
+
+type keySpec struct {
+	Desktop  *string           `json:"desktop"`
+	Consumer *uint16           `json:"consumer"`
+	Layer    *int              `json:"layer"`
+	OSL      bool              `json:"osl"`
+	Mode     *string           `json:"mode"`
+	Switch   *string           `json:"switch"`
+	Std      json.RawMessage   `json:"std"`
+	Mac      json.RawMessage   `json:"mac"`
+	Unicode  *string           `json:"unicode"`
+	Compose  *string           `json:"compose"`
+	Shortcut *string           `json:"shortcut"`
+	String   *string           `json:"string"`
+	Virtual  []json.RawMessage `json:"virtual"`
+	Macro    *string           `json:"macro"`
+	Slot     int               `json:"slot"`
+	Tap      json.RawMessage   `json:"tap"`
+	Hold     json.RawMessage   `json:"hold"`
+	Taps     []json.RawMessage `json:"taps"`
+	Holds    []json.RawMessage `json:"holds"`
+}
+
+// Map names of compiled keys so that the keymap file can refer to them.
+var keyNames = map[string]key{
+	"kcNone":       kcNone,
+	"kcLayer0":     kcLayer0,
+	"kcLayer1":     kcLayer1,
+	"kcLayer2":     kcLayer2,
+	"kcLayer3":     kcLayer3,
+	"kcDeviceABC":  kcDeviceABC,
+	"kcDeviceDEF":  kcDeviceDEF,
+	"kcDeviceGHI":  kcDeviceGHI,
+	"kcDeviceJKL":  kcDeviceJKL,
+	"kcDeviceUIN":  kcDeviceUIN,
+	"kcDeviceMNO":  kcDeviceMNO,
+	"kcDeviceTMP":  kcDeviceTMP,
+	"kcLeader":     kcLeader,
+	"kcCapsWord":   kcCapsWord,
+	"kcASUp":       kcASUp,
+	"kcASDown":     kcASDown,
+	"kcASToggle":   kcASToggle,
+	"kcASReport":   kcASReport,
+	"kcMacroRec0":  kcMacroRec0,
+	"kcMacroRec1":  kcMacroRec1,
+	"kcMacroStop":  kcMacroStop,
+	"kcMacroPlay0": kcMacroPlay0,
+	"kcMacroPlay1": kcMacroPlay1,
+	"kcMsBtn1":     kcMsBtn1,
+	"kcMsBtn2":     kcMsBtn2,
+	"kcMsBtn3":     kcMsBtn3,
+	"kcMsUp":       kcMsUp,
+	"kcMsDown":     kcMsDown,
+	"kcMsLeft":     kcMsLeft,
+	"kcMsRight":    kcMsRight,
+	"kcWhUp":       kcWhUp,
+	"kcWhDown":     kcWhDown,
+	"kcFnModLock":  kcFnModLock,
+	"kcFnTmpReset": kcFnTmpReset,
+	"kcFnPowerOff": kcFnPowerOff,
+	"kcFnReboot":   kcFnReboot,
+	"kcLCtrl":      kcLCtrl,
+	"kcLShift":     kcLShift,
+	"kcLAlt":       kcLAlt,
+	"kcLGUI":       kcLGUI,
+	"kcRAlt":       kcRAlt,
+	"kc1":          kc1,
+	"kcExclam":     kcExclam,
+	"kc2":          kc2,
+	"kcAt":         kcAt,
+	"kc3":          kc3,
+	"kcHash":       kcHash,
+	"kc4":          kc4,
+	"kcDollar":     kcDollar,
+	"kc5":          kc5,
+	"kcPrcnt":      kcPrcnt,
+	"kc6":          kc6,
+	"kcCaret":      kcCaret,
+	"kc7":          kc7,
+	"kcAmper":      kcAmper,
+	"kc8":          kc8,
+	"kcAstrsk":     kcAstrsk,
+	"kc9":          kc9,
+	"kcLParen":     kcLParen,
+	"kc0":          kc0,
+	"kcRParen":     kcRParen,
+	"kcQLower":     kcQLower,
+	"kcQUpper":     kcQUpper,
+	"kcWLower":     kcWLower,
+	"kcWUpper":     kcWUpper,
+	"kcFLower":     kcFLower,
+	"kcFUpper":     kcFUpper,
+	"kcPLower":     kcPLower,
+	"kcPUpper":     kcPUpper,
+	"kcGLower":     kcGLower,
+	"kcGUpper":     kcGUpper,
+	"kcJLower":     kcJLower,
+	"kcJUpper":     kcJUpper,
+	"kcLLower":     kcLLower,
+	"kcLUpper":     kcLUpper,
+	"kcULower":     kcULower,
+	"kcUUpper":     kcUUpper,
+	"kcYLower":     kcYLower,
+	"kcYUpper":     kcYUpper,
+	"kcSColon":     kcSColon,
+	"kcColon":      kcColon,
+	"kcALower":     kcALower,
+	"kcAUpper":     kcAUpper,
+	"kcRLower":     kcRLower,
+	"kcRUpper":     kcRUpper,
+	"kcSLower":     kcSLower,
+	"kcSUpper":     kcSUpper,
+	"kcTLower":     kcTLower,
+	"kcTUpper":     kcTUpper,
+	"kcDLower":     kcDLower,
+	"kcDUpper":     kcDUpper,
+	"kcHLower":     kcHLower,
+	"kcHUpper":     kcHUpper,
+	"kcNLower":     kcNLower,
+	"kcNUpper":     kcNUpper,
+	"kcELower":     kcELower,
+	"kcEUpper":     kcEUpper,
+	"kcILower":     kcILower,
+	"kcIUpper":     kcIUpper,
+	"kcOLower":     kcOLower,
+	"kcOUpper":     kcOUpper,
+	"kcZLower":     kcZLower,
+	"kcZUpper":     kcZUpper,
+	"kcXLower":     kcXLower,
+	"kcXUpper":     kcXUpper,
+	"kcCLower":     kcCLower,
+	"kcCUpper":     kcCUpper,
+	"kcVLower":     kcVLower,
+	"kcVUpper":     kcVUpper,
+	"kcBLower":     kcBLower,
+	"kcBUpper":     kcBUpper,
+	"kcKLower":     kcKLower,
+	"kcKUpper":     kcKUpper,
+	"kcMLower":     kcMLower,
+	"kcMUpper":     kcMUpper,
+	"kcComma":      kcComma,
+	"kcLAngle":     kcLAngle,
+	"kcDot":        kcDot,
+	"kcRAngle":     kcRAngle,
+	"kcSlash":      kcSlash,
+	"kcQues":       kcQues,
+	"kcTab":        kcTab,
+	"kcSpace":      kcSpace,
+	"kcEnter":      kcEnter,
+	"kcBslash":     kcBslash,
+	"kcPipe":       kcPipe,
+	"kcGrave":      kcGrave,
+	"kcTilde":      kcTilde,
+	"kcMinus":      kcMinus,
+	"kcUnders":     kcUnders,
+	"kcEqual":      kcEqual,
+	"kcPlus":       kcPlus,
+	"kcLBrack":     kcLBrack,
+	"kcLBrace":     kcLBrace,
+	"kcRBrack":     kcRBrack,
+	"kcRBrace":     kcRBrace,
+	"kcQuote":      kcQuote,
+	"kcDQuote":     kcDQuote,
+	"kcPrtScn":     kcPrtScn,
+	"kcApp":        kcApp,
+	"kcCapsLk":     kcCapsLk,
+	"kcVolMut":     kcVolMut,
+	"kcEscape":     kcEscape,
+	"kcBspace":     kcBspace,
+	"kcVolDn":      kcVolDn,
+	"kcVolUp":      kcVolUp,
+	"kcLeft":       kcLeft,
+	"kcDown":       kcDown,
+	"kcUp":         kcUp,
+	"kcRight":      kcRight,
+	"kcDelete":     kcDelete,
+	"kcHome":       kcHome,
+	"kcPageUp":     kcPageUp,
+	"kcEnd":        kcEnd,
+	"kcInsert":     kcInsert,
+	"kcPageDn":     kcPageDn,
+	"kcCopy":       kcCopy,
+	"kcPaste":      kcPaste,
+	"kcUndo":       kcUndo,
+	"kcRedo":       kcRedo,
+	"kcSelWordL":   kcSelWordL,
+	"kcDelWord":    kcDelWord,
+	"kcLockScrn":   kcLockScrn,
+	"kcSwitchApp":  kcSwitchApp,
+	"kcNewTab":     kcNewTab,
+	"kcScrnShot":   kcScrnShot,
+	"kcFFMenu":     kcFFMenu,
+	"kcATilde":     kcATilde,
+	"kcETilde":     kcETilde,
+	"kcITilde":     kcITilde,
+	"kcOTilde":     kcOTilde,
+	"kcUTilde":     kcUTilde,
+	"kcNTilde":     kcNTilde,
+	"kcUDier":      kcUDier,
+	"kcExclInv":    kcExclInv,
+	"kcQuesInv":    kcQuesInv,
+	"kcEmGrin":     kcEmGrin,
+	"kcEmCry":      kcEmCry,
+	"kcEmJoy":      kcEmJoy,
+	"kcEmSweat":    kcEmSweat,
+	"kcEmSmile":    kcEmSmile,
+	"kcEmThumb":    kcEmThumb,
+	"kcEmThink":    kcEmThink,
+	"kcEmWink":     kcEmWink,
+	"kcEmPout":     kcEmPout,
+	"kcEmFPalm":    kcEmFPalm,
+}
+
+func parseKeycode(name string) (uint8, error) {
+	if code, ok := keycodes[name]; ok {
+		return code, nil
+	}
+	return 0, fmt.Errorf("unknown keycode %q", name)
+}
+
+func parseKey(data json.RawMessage) (key, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil, nil
+	}
+
+	// Look up strings in the table of compiled keys.
+	if data[0] == '"' {
+		var name string
+		if err := json.Unmarshal(data, &name); err != nil {
+			return nil, err
+		}
+		if k, ok := keyNames[name]; ok {
+			return k, nil
+		}
+		return nil, fmt.Errorf("unknown key %q", name)
+	}
+
+	var spec keySpec
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&spec); err != nil {
+		return nil, err
+	}
+
+	// Exactly one kind of key must be given. The osl and mode fields only
+	// modify layer keys.
+	n := 0
+	for _, set := range []bool{
+		spec.Desktop != nil, spec.Consumer != nil, spec.Layer != nil,
+		spec.Switch != nil, spec.Std != nil || spec.Mac != nil,
+		spec.Unicode != nil, spec.Compose != nil, spec.String != nil,
+		spec.Virtual != nil, spec.Shortcut != nil,
+		spec.Tap != nil || spec.Hold != nil,
+		spec.Taps != nil || spec.Holds != nil,
+		spec.Macro != nil,
+	} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, errors.New("key must have exactly one kind")
+	}
+	if (spec.OSL || spec.Mode != nil) && spec.Layer == nil {
+		return nil, errors.New("osl and mode require layer")
+	}
+	if spec.OSL && spec.Mode != nil {
+		return nil, errors.New("osl conflicts with mode")
+	}
+
+	switch {
+	case spec.Desktop != nil:
+		code, err := parseKeycode(*spec.Desktop)
+		if err != nil {
+			return nil, err
+		}
+		return keyD(code), nil
+	case spec.Consumer != nil:
+		return consumerKey(*spec.Consumer), nil
+	case spec.Layer != nil:
+		k := layerKey{layer: *spec.Layer}
+		if spec.OSL {
+			k.mode = layerOSL
+		} else if spec.Mode != nil {
+			var err error
+			if k.mode, err = parseLayerMode(*spec.Mode); err != nil {
+				return nil, err
+			}
+		}
+		return k, nil
+	case spec.Switch != nil:
+		return switchKey(*spec.Switch), nil
+	case spec.Std != nil || spec.Mac != nil:
+		std, err := parseKey(spec.Std)
+		if err != nil {
+			return nil, fmt.Errorf("std: %v", err)
+		}
+		mac, err := parseKey(spec.Mac)
+		if err != nil {
+			return nil, fmt.Errorf("mac: %v", err)
+		}
+		if std == nil || mac == nil {
+			return nil, errors.New("intl key requires std and mac")
+		}
+		return intlKey{stdKey: std, macKey: mac}, nil
+	case spec.Unicode != nil:
+		// A single character is a unicodeKey. Multiple characters are joined
+		// with zero width joiners as a unicodeCompoundKey.
+		var k unicodeCompoundKey
+		for _, r := range *spec.Unicode {
+			k = append(k, unicodeKey(r))
+		}
+		switch len(k) {
+		case 0:
+			return nil, errors.New("empty unicode key")
+		case 1:
+			return k[0], nil
+		default:
+			return k, nil
+		}
+	case spec.Compose != nil:
+		r := []rune(*spec.Compose)
+		if len(r) != 1 {
+			return nil, errors.New("compose key requires a single character")
+		}
+		return composeKey(r[0]), nil
+	case spec.Shortcut != nil:
+		k := shortcutKey(*spec.Shortcut)
+		if _, ok := shortcuts[k]; !ok {
+			return nil, fmt.Errorf("unknown shortcut %q", *spec.Shortcut)
+		}
+		return k, nil
+	case spec.Macro != nil:
+		op, ok := macroOps[*spec.Macro]
+		if !ok {
+			return nil, fmt.Errorf("unknown macro operation %q", *spec.Macro)
+		}
+		if spec.Slot < 0 || spec.Slot >= macroSlots {
+			return nil, fmt.Errorf("slot %d does not exist", spec.Slot)
+		}
+		return macroKey{op: op, slot: spec.Slot}, nil
+	case spec.String != nil:
+		return stringKey(*spec.String), nil
+	case spec.Tap != nil || spec.Hold != nil:
+		tap, err := parseKey(spec.Tap)
+		if err != nil {
+			return nil, fmt.Errorf("tap: %v", err)
+		}
+		hold, err := parseKey(spec.Hold)
+		if err != nil {
+			return nil, fmt.Errorf("hold: %v", err)
+		}
+		if tap == nil || hold == nil {
+			return nil, errors.New("tap-hold key requires tap and hold")
+		}
+		return tapHoldKey{tap: tap, hold: hold}, nil
+	case spec.Taps != nil || spec.Holds != nil:
+		var k tapDanceKey
+		defined := false
+		for i, value := range spec.Taps {
+			v, err := parseKey(value)
+			if err != nil {
+				return nil, fmt.Errorf("taps[%d]: %v", i, err)
+			}
+			k.taps = append(k.taps, v)
+			defined = defined || v != nil
+		}
+		for i, value := range spec.Holds {
+			v, err := parseKey(value)
+			if err != nil {
+				return nil, fmt.Errorf("holds[%d]: %v", i, err)
+			}
+			k.holds = append(k.holds, v)
+			defined = defined || v != nil
+		}
+		if !defined {
+			return nil, errors.New("tap dance key requires an action")
+		}
+		return k, nil
+	default:
+		var k virtualKey
+		for i, value := range spec.Virtual {
+			v, err := parseKey(value)
+			if err != nil {
+				return nil, fmt.Errorf("virtual[%d]: %v", i, err)
+			}
+			if v == nil {
+				return nil, fmt.Errorf("virtual[%d]: undefined key", i)
+			}
+			k = append(k, v)
+		}
+		return k, nil
+	}
+}
+
+// Define error type for reporting every problem in a file at once.
+type errorList []error
+
+func (e errorList) Error() string {
+	s := make([]string, len(e))
+	for key, value := range e {
+		s[key] = value.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+func parseKeymap(data []byte) (*keymap, error) {
+	var f keymapFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if len(f.Layers) == 0 {
+		return nil, errors.New("keymap has no layers")
+	}
+	if err := validateLayerCount(len(f.Layers)); err != nil {
+		return nil, err
+	}
+
+	var errs errorList
+	km := &keymap{
+		tapping:   defaultTapping,
+		comboTerm: defaultComboTerm,
+		leader:    leaderConfig{timeout: defaultLeaderTimeout},
+		autoShift: autoShiftConfig{timeout: defaultAutoShiftTimeout},
+	}
+	if f.Tapping != nil {
+		km.tapping = *f.Tapping
+		if km.tapping.Term <= 0 {
+			errs = append(errs, errors.New("tapping term must be positive"))
+		}
+	}
+	if f.ComboTerm != nil {
+		km.comboTerm = *f.ComboTerm
+		if km.comboTerm <= 0 {
+			errs = append(errs, errors.New("combo term must be positive"))
+		}
+	}
+
+	l := make([]layer, len(f.Layers))
+	for i, value := range f.Layers {
+		l[i] = make(layer, len(value))
+		for j, data := range value {
+			k, err := parseKey(data)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("layer %d, position %d: %v", i, j, err))
+			}
+			l[i][j] = k
+		}
+	}
+
+	if len(f.Combos) > len(f.Layers) {
+		errs = append(errs, fmt.Errorf("combos for %d layers, expected at most %d", len(f.Combos), len(f.Layers)))
+		f.Combos = f.Combos[:len(f.Layers)]
+	}
+	km.combos = make([][]combo, len(f.Combos))
+	for i, value := range f.Combos {
+		km.combos[i] = make([]combo, len(value))
+		for j, spec := range value {
+			c, err := parseCombo(spec, len(l[i]))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("layer %d, combo %d: %v", i, j, err))
+			}
+			km.combos[i][j] = c
+		}
+	}
+
+	if len(f.Overrides) > len(f.Layers) {
+		errs = append(errs, fmt.Errorf("overrides for %d layers, expected at most %d", len(f.Overrides), len(f.Layers)))
+		f.Overrides = f.Overrides[:len(f.Layers)]
+	}
+	km.overrides = make([][]keyOverride, len(f.Overrides))
+	for i, value := range f.Overrides {
+		km.overrides[i] = make([]keyOverride, len(value))
+		for j, spec := range value {
+			o, err := parseOverride(spec)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("layer %d, override %d: %v", i, j, err))
+			}
+			km.overrides[i][j] = o
+		}
+	}
+
+	if f.Leader != nil {
+		var err error
+		if km.leader, err = parseLeader(*f.Leader); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if f.AutoShift != nil {
+		var err error
+		if km.autoShift, err = parseAutoShift(*f.AutoShift); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if errs != nil {
+		return nil, errs
+	}
+	km.layers = l
+	return km, nil
+}
+
+// Get the layers of a device, which are the layers of the keymap unless the
+// device overrides them.
+func (km *keymap) deviceLayers(name string) []layer {
+	if l, ok := km.devices[name]; ok {
+		return l
+	}
+	return km.layers
+}
+
+// Build the layers of every device that overrides layers or positions of the
+// keymap. Layers are copied before they are changed so that the keymap and the
+// other devices are left as they are.
+func (km *keymap) applyDevices(c configFile) error {
+	var errs errorList
+	names := make([]string, 0, len(c.Devices))
+	for name := range c.Devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	km.devices = make(map[string][]layer)
+	for _, name := range names {
+		d := c.Devices[name]
+		if d.Layers == nil && d.Keys == nil {
+			continue
+		}
+		l := append([]layer{}, km.layers...)
+
+		// Replace layers in order so that a layer may be added after the
+		// last one, including one added by this device.
+		var indices []int
+		for i := range d.Layers {
+			indices = append(indices, i)
+		}
+		sort.Ints(indices)
+		for _, i := range indices {
+			if i < 0 || i > len(l) {
+				errs = append(errs, fmt.Errorf("device %s, layer %d: expected at most layer %d", name, i, len(l)))
+				continue
+			}
+			value := make(layer, len(d.Layers[i]))
+			for j, data := range d.Layers[i] {
+				k, err := parseKey(data)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("device %s, layer %d, position %d: %v", name, i, j, err))
+				}
+				value[j] = k
+			}
+			if i == len(l) {
+				l = append(l, value)
+			} else {
+				l[i] = value
+			}
+		}
+		if err := validateLayerCount(len(l)); err != nil {
+			errs = append(errs, fmt.Errorf("device %s: %v", name, err))
+		}
+
+		indices = nil
+		for i := range d.Keys {
+			indices = append(indices, i)
+		}
+		sort.Ints(indices)
+		for _, i := range indices {
+			if i < 0 || i >= len(l) {
+				errs = append(errs, fmt.Errorf("device %s, layer %d: layer is not defined", name, i))
+				continue
+			}
+			var positions []int
+			for j := range d.Keys[i] {
+				positions = append(positions, j)
+			}
+			sort.Ints(positions)
+			l[i] = append(layer{}, l[i]...)
+			for _, j := range positions {
+				if j < 0 || j >= len(l[i]) {
+					errs = append(errs, fmt.Errorf("device %s, layer %d, position %d: position is not defined", name, i, j))
+					continue
+				}
+				k, err := parseKey(d.Keys[i][j])
+				if err != nil {
+					errs = append(errs, fmt.Errorf("device %s, layer %d, position %d: %v", name, i, j, err))
+				}
+				l[i][j] = k
+			}
+		}
+		km.devices[name] = l
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// Load the keymap file. If the file does not exist, return defaultKeymap.
+func loadKeymap(path string) (*keymap, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		km := defaultKeymap
+		return &km, nil
+	} else if err != nil {
+		return nil, err
+	}
+	km, err := parseKeymap(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return km, nil
+}
+
+// The device configuration file is JSON in the same form as defaultConfig. Each
+// device has a transport of gadget, uinput, or bluez, a platform of android,
+// linux, macos, or windows, and a host layout of us, uk, colemak, dvorak,
+// azerty, or qwertz, which defaults to us. Bluetooth devices are identified by
+// MAC address. A Bluetooth device with no MAC address accepts temporary
+// connections from any host. Devices with tap set receive every key as a press
+// immediately followed by a release instead of held keys, and their modifiers
+// toggle instead of being held. The unicode method of a device is one of none,
+// linux, macos, wincompose, or altnumpad and defaults to the usual method of
+// its platform, which is none for android. Setting it to none keeps control
+// check from reporting the Unicode keys of the device. Likewise, the compose
+// method is one of none, intl, macos, or linux. A device may replace whole layers of the keymap with "layers", as in
+// {"3": [...]}, including a layer right after the last one to add it, and
+// single positions with "keys", as in {"0": {"70": "kcSpace"}}. A device may
+// also set its own auto shift groups with "autoShift", where [] turns auto
+// shift off for the device. The geometry of the keyboard defaults to
+// defaultGeometry.
+type configFile struct {
+	Left     string                `json:"left"`
+	Right    string                `json:"right"`
+	Default  string                `json:"default"`
+	Geometry *geometry             `json:"geometry"`
+	Devices  map[string]deviceSpec `json:"devices"`
+}
+
+type deviceSpec struct {
+	Transport string `json:"transport"`
+	MAC       string `json:"mac"`
+	Platform  string `json:"platform"`
+	Host      string `json:"host"`
+	Unicode   string `json:"unicode"`
+	Compose   string `json:"compose"`
+	Tap       bool   `json:"tap"`
+
+	AutoShift []string `json:"autoShift"`
+
+	Layers map[int][]json.RawMessage       `json:"layers"`
+	Keys   map[int]map[int]json.RawMessage `json:"keys"`
+}
+
+var platforms = map[string]platform{
+	"android": platAndroid,
+	"linux":   platLinux,
+	"macos":   platMacOS,
+	"windows": platWindows,
+}
+
+// Get the Unicode method of the device, which defaults to the method of its
+// platform.
+func (d deviceSpec) unicodeMethod() unicodeMethod {
+	if d.Unicode != "" {
+		return unicodeMethods[d.Unicode]
+	}
+	return platformUnicode[platforms[d.Platform]]
+}
+
+// Get the layout of the host of the device, which defaults to us.
+func (d deviceSpec) hostLayout() hostLayout {
+	if d.Host != "" {
+		return hostLayouts[d.Host]
+	}
+	return hostLayouts["us"]
+}
+
+// Get the compose method of the device, which defaults to the method of its
+// platform.
+func (d deviceSpec) composeMethod() composeMethod {
+	if d.Compose != "" {
+		return composeMethods[d.Compose]
+	}
+	return platformCompose[platforms[d.Platform]]
+}
+
+func (c configFile) validate() error {
+	var errs errorList
+	if c.Left == "" || c.Right == "" {
+		errs = append(errs, errors.New("left and right must be set"))
+	}
+	if _, ok := c.Devices[c.Default]; !ok {
+		errs = append(errs, fmt.Errorf("default device %q is not defined", c.Default))
+	}
+	if err := c.Geometry.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("geometry: %v", err))
+	}
+
+	// Sort device names so that errors are reported in a consistent order.
+	names := make([]string, 0, len(c.Devices))
+	for name := range c.Devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Gadget, uinput, and temporary Bluetooth devices are backed by a single
+	// resource and may only be defined once. Bluetooth MAC addresses must be
+	// unique since they identify the device.
+	owners := make(map[string]string)
+	for _, name := range names {
+		d := c.Devices[name]
+		if _, ok := platforms[d.Platform]; !ok {
+			errs = append(errs, fmt.Errorf("device %s: unknown platform %q", name, d.Platform))
+		}
+		if _, ok := hostLayouts[d.Host]; d.Host != "" && !ok {
+			errs = append(errs, fmt.Errorf("device %s: unknown host layout %q", name, d.Host))
+		}
+		if _, ok := unicodeMethods[d.Unicode]; d.Unicode != "" && !ok {
+			errs = append(errs, fmt.Errorf("device %s: unknown unicode method %q", name, d.Unicode))
+		}
+		if _, ok := composeMethods[d.Compose]; d.Compose != "" && !ok {
+			errs = append(errs, fmt.Errorf("device %s: unknown compose method %q", name, d.Compose))
+		}
+		if err := checkAutoShiftGroups(d.AutoShift); err != nil {
+			errs = append(errs, fmt.Errorf("device %s: auto shift: %v", name, err))
+		}
+
+		var owner string
+		switch d.Transport {
+		case "gadget", "uinput":
+			if d.MAC != "" {
+				errs = append(errs, fmt.Errorf("device %s: %s does not use a MAC address", name, d.Transport))
+			}
+			owner = d.Transport
+		case "bluez":
+			if d.MAC == "" {
+				owner = "temporary Bluetooth"
+			} else if mac, err := net.ParseMAC(d.MAC); err != nil {
+				errs = append(errs, fmt.Errorf("device %s: %v", name, err))
+			} else {
+				owner = mac.String()
+			}
+		default:
+			errs = append(errs, fmt.Errorf("device %s: unknown transport %q", name, d.Transport))
+		}
+		if other, ok := owners[owner]; ok {
+			errs = append(errs, fmt.Errorf("device %s: %s is already used by %s", name, owner, other))
+		} else if owner != "" {
+			owners[owner] = name
+		}
+	}
+
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// Load the device configuration file. If the file does not exist, return
+// defaultConfig.
+func loadConfig(path string) (configFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return defaultConfig, defaultConfig.validate()
+	} else if err != nil {
+		return configFile{}, err
+	}
+
+	var c configFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return configFile{}, fmt.Errorf("%s: %v", path, err)
+	}
+	if c.Geometry == nil {
+		c.Geometry = &defaultGeometry
+	}
+	if err := c.validate(); err != nil {
+		return configFile{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Load and validate the keymap and the device configuration together.
+func loadSettings() (*keymap, configFile, error) {
+	km, err := loadKeymap(*keymapPath)
+	if err != nil {
+		return nil, configFile{}, err
+	}
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		return nil, configFile{}, err
+	}
+	if err := km.applyDevices(c); err != nil {
+		return nil, configFile{}, err
+	}
+	if err := checkKeymap(km, c); err != nil {
+		return nil, configFile{}, err
+	}
+	return km, c, nil
+}
+
+// Cache writers by the resource backing them so that reloading the
+// configuration keeps existing connections and key state. Gadget and uinput
+// writers are keyed by transport and Bluetooth writers by MAC address.
+var writers = make(map[string]writer)
+
+// Create a writer for every configured device, reusing cached writers where
+// possible. The configuration must have been validated.
+func newDevices(c configFile) (map[string]config, error) {
+	// Create gadget and uinput writers first since they are the only writers
+	// that can fail. This leaves Bluetooth untouched on error.
+	for _, value := range c.Devices {
+		if _, ok := writers[value.Transport]; ok {
+			continue
+		}
+		var w writer
+		var err error
+		switch value.Transport {
+		case "gadget":
+			w, err = newGadgetWriter()
+		case "uinput":
+			w, err = newUinputWriter()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		writers[value.Transport] = w
+	}
+
+	d := make(map[string]config)
+	for name, value := range c.Devices {
+		key := value.Transport
+		if key == "bluez" {
+			// Use the canonical form of the MAC address so that it matches the
+			// address reported by incoming connections.
+			var mac string
+			if value.MAC != "" {
+				hw, _ := net.ParseMAC(value.MAC)
+				mac = hw.String()
+			}
+			key = "bluez " + mac
+			if _, ok := writers[key]; !ok {
+				writers[key] = newBlueZWriter(mac)
+			}
+		}
+		d[name] = config{
+			writer:    writers[key],
+			layout:    value.hostLayout(),
+			platform:  platforms[value.Platform],
+			unicode:   value.unicodeMethod(),
+			compose:   value.composeMethod(),
+			tap:       value.Tap,
+			autoShift: value.AutoShift,
+		}
+	}
+
+	return d, nil
+}
+
+// Stop accepting connections from Bluetooth devices whose writers no device in
+// d uses. This must only be called once d is current and nothing is held
+// through the removed writers. Gadget and uinput writers are kept since they
+// are cheap to keep open.
+func retireWriters(d map[string]config) {
+	for key, w := range writers {
+		mac := strings.TrimPrefix(key, "bluez ")
+		if mac == key {
+			continue
+		}
+		used := false
+		for _, value := range d {
+			used = used || value.writer == w
+		}
+		if !used {
+			removeBlueZWriter(mac)
+			delete(writers, key)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Each half reports its switch matrix as a bit field following the leading
+// report ID. Bit row+rows*column represents the switch at the given row and
+// column, so the field can hold at most 56 switches.
+const maxMatrixBits = 56
+
+// Describe the switch matrix of one keyboard half. Logical positions are
+// numbered from top to bottom and left to right. The columns of a half are
+// mirrored if its column 0 is on the right, as is the case for the left half of
+// the ErgoBlue. Skip lists matrix bits that have no switch.
+type halfGeometry struct {
+	Rows    int   `json:"rows"`
+	Columns int   `json:"columns"`
+	Mirror  bool  `json:"mirror"`
+	Skip    []int `json:"skip"`
+}
+
+// Describe both halves of the keyboard. Positions on the left half come before
+// positions on the right half in the keymap.
+type geometry struct {
+	Left  halfGeometry `json:"left"`
+	Right halfGeometry `json:"right"`
+}
+
+var defaultGeometry = geometry{
+	Left:  halfGeometry{Rows: 6, Columns: 7, Mirror: true, Skip: []int{2, 4, 10, 41}},
+	Right: halfGeometry{Rows: 6, Columns: 7, Skip: []int{2, 4, 10, 41}},
+}
+
+func (h halfGeometry) skipped(bit int) bool {
+	for _, value := range h.Skip {
+		if value == bit {
+			return true
+		}
+	}
+	return false
+}
+
+// Compute the grid of the half as displayed, with the logical position of each
+// switch relative to the first position of the half. Missing switches are -1.
+func (h halfGeometry) grid() [][]int {
+	grid := make([][]int, h.Rows)
+	i := 0
+	for j := range grid {
+		grid[j] = make([]int, h.Columns)
+		for col := range grid[j] {
+			if h.skipped(h.bit(j, col)) {
+				grid[j][col] = -1
+			} else {
+				grid[j][col] = i
+				i++
+			}
+		}
+	}
+	return grid
+}
+
+// Get the matrix bit of the switch at the given row and displayed column.
+func (h halfGeometry) bit(row, col int) int {
+	if h.Mirror {
+		col = h.Columns - 1 - col
+	}
+	return row + h.Rows*col
+}
+
+// List the matrix bit of each logical position of the half.
+func (h halfGeometry) bits() []uint {
+	var bits []uint
+	for j := 0; j < h.Rows; j++ {
+		for col := 0; col < h.Columns; col++ {
+			if l := h.bit(j, col); !h.skipped(l) {
+				bits = append(bits, uint(l))
+			}
+		}
+	}
+	return bits
+}
+
+func (h halfGeometry) size() int {
+	return len(h.bits())
+}
+
+func (h halfGeometry) validate() error {
+	if h.Rows <= 0 || h.Columns <= 0 {
+		return errors.New("rows and columns must be positive")
+	}
+	if h.Rows*h.Columns > maxMatrixBits {
+		return fmt.Errorf("%d switches do not fit in %d bits", h.Rows*h.Columns, maxMatrixBits)
+	}
+	for _, value := range h.Skip {
+		if value < 0 || value >= h.Rows*h.Columns {
+			return fmt.Errorf("skipped bit %d is outside the matrix", value)
+		}
+	}
+	return nil
+}
+
+// Get the number of positions in each layer.
+func (g geometry) size() int {
+	return g.Left.size() + g.Right.size()
+}
+
+func (g geometry) validate() error {
+	if err := g.Left.validate(); err != nil {
+		return fmt.Errorf("left: %v", err)
+	}
+	if err := g.Right.validate(); err != nil {
+		return fmt.Errorf("right: %v", err)
+	}
+	return nil
+}
@@ -6,7 +6,9 @@ import (
 )
 
 // The main keyboard descriptor was developed from https://goo.gl/xjNxy3. The
-// consumer page descriptor was developed from https://goo.gl/qEeXj7. See
+// consumer page descriptor was developed from https://goo.gl/qEeXj7. The mouse
+// descriptor follows the boot mouse in appendix E.10 of the HID specification
+// with a wheel added. See
 // https://goo.gl/RYBXdb for a comprehensive guide on HID descriptors.
 // https://goo.gl/HZydaN provides a tool to visualize the descriptor.
 var keyboardReport = []byte{
@@ -43,6 +45,34 @@ var keyboardReport = []byte{
 	0x2a, 0x9c, 0x02, // Usage Maximum (AC Distribute Vertically)
 	0x81, 0x00, // Input
 	0xc0, // End Collection
+	0x05, 0x01, // Usage Page (Generic Desktop Ctrls)
+	0x09, 0x02, // Usage (Mouse)
+	0xa1, 0x01, // Collection (Application)
+	0x85, 0x03, // Report ID (3)
+	0x09, 0x01, // Usage (Pointer)
+	0xa1, 0x00, // Collection (Physical)
+	0x95, 0x05, // Report Count (5)
+	0x75, 0x01, // Report Size (1)
+	0x05, 0x09, // Usage Page (Button)
+	0x19, 0x01, // Usage Minimum (0x01)
+	0x29, 0x05, // Usage Maximum (0x05)
+	0x15, 0x00, // Logical Minimum (0)
+	0x25, 0x01, // Logical Maximum (1)
+	0x81, 0x02, // Input
+	0x95, 0x01, // Report Count (1)
+	0x75, 0x03, // Report Size (3)
+	0x81, 0x01, // Input (Padding)
+	0x95, 0x03, // Report Count (3)
+	0x75, 0x08, // Report Size (8)
+	0x05, 0x01, // Usage Page (Generic Desktop Ctrls)
+	0x09, 0x30, // Usage (X)
+	0x09, 0x31, // Usage (Y)
+	0x09, 0x38, // Usage (Wheel)
+	0x15, 0x81, // Logical Minimum (-127)
+	0x25, 0x7f, // Logical Maximum (127)
+	0x81, 0x06, // Input (Relative)
+	0xc0, // End Collection
+	0xc0, // End Collection
 }
 
 type hidWriter struct {
@@ -93,6 +123,10 @@ func (w *hidWriter) sendConsumer(key uint16) {
 	w.Write(data)
 }
 
+func (w *hidWriter) sendMouse(buttons uint8, x, y, wheel int8) {
+	w.Write([]byte{0x03, buttons, byte(x), byte(y), byte(wheel)})
+}
+
 func newHIDWriter(w io.Writer) *hidWriter {
 	return &hidWriter{Writer: w, keys: make(map[uint8]bool)}
 }
@@ -47,10 +47,20 @@ func handleDev(file string, eventChan chan event) error {
 }
 
 func handleInput() error {
-	// Initialize channel for keyboard events and handle concurrently.
+	// Initialize channel for keyboard events and handle concurrently. Reload
+	// requests are handled by the same goroutine so that they never interleave
+	// with key handling.
 	eventChan := make(chan event)
-	s := &state{device: defaultDevice}
-	go s.handleEvent(eventChan)
+	reloadChan := make(chan bool, 1)
+	s := &state{
+		device: defaultDevice,
+		keys:   make([]bool, board.size()),
+		held:   make([]func(), board.size()),
+	}
+	go s.handleEvent(eventChan, reloadChan)
+	if err := watchReload(reloadChan); err != nil {
+		return err
+	}
 
 	// Use inotify to watch /dev for new inputs. Allocate a sufficient buffer
 	// for inotify event data.
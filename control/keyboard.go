@@ -30,29 +30,48 @@ type writer interface {
 	pressDesktop(uint8)
 	releaseDesktop(uint8)
 	sendConsumer(uint16)
+	sendMouse(buttons uint8, x, y, wheel int8)
 }
 
+// Define device configuration. If tap is set, every key is pressed and
+// released as soon as it is pressed, which suits hosts that handle held keys
+// poorly. Otherwise keys that support it are held until they are released.
 type config struct {
 	writer   writer
-	qwerty   bool
+	layout   hostLayout
 	platform platform
+	unicode  unicodeMethod
+	compose  composeMethod
+	tap      bool
+
+	// Set to the auto shift groups of the device if it overrides those of
+	// the keymap.
+	autoShift []string
 }
 
 type event struct {
 	data []byte
-	left bool
+	mac  string
+}
+
+// Define a key press or release at a position in the keymap.
+type keyEvent struct {
+	pos  int
+	down bool
+	at   time.Time
 }
 
 type state struct {
 	device string
 
-	// Track whether each key is currently actuated.
-	keys [76]bool
+	// Track whether each key is currently actuated. For held keys, track the
+	// function that releases the key.
+	keys []bool
+	held []func()
 
-	// Track layer. If the layer is a one-shot layer, the user will return to
-	// the default layer after the next key that does not change the layer.
-	layer    int
-	layerOSL bool
+	// Track layers. If a layer is a one-shot layer, the user will return to
+	// the previous layers after the next key that does not change the layers.
+	layer layerState
 
 	// Track whether a locking key is active.
 	lock lock
@@ -61,6 +80,59 @@ type state struct {
 	// modifiers are not released until it is pressed again. Even though we only
 	// need 5 out of the 8 modifiers, allow all 8 to simplify code.
 	modifiers, modLocks [8]bool
+
+	// Track the held key that unlocked modifiers apply to. The modifiers are
+	// released when that key is released or when another key is pressed, so
+	// that holding a key with a modifier repeats the modified key.
+	modOwner *bool
+
+	// Track the function that restores the modifiers of the host that the
+	// held desktop key changed, such as Shift for ! on a host where it is
+	// shifted. They are restored when another key is pressed so that they do
+	// not apply to that key as well.
+	hostRestore func()
+
+	// Count the keys pressed so far, which tells whether another key was
+	// pressed while a modifier key was held.
+	presses int
+
+	// Track the tap-hold, tap dance, or auto shift key waiting to be resolved
+	// and the events that follow it, which are handled once it is resolved.
+	tapHold   *pendingTapHold
+	tapDance  *pendingTapDance
+	autoShift *pendingAutoShift
+	queue     []keyEvent
+
+	// Track the presses that may be part of a combo. Events that follow them
+	// stay queued until the combo is resolved.
+	chord []keyEvent
+
+	// Track the leader sequence being typed.
+	sequence *pendingSequence
+
+	// Track when the key being pressed was pressed, from which the timeouts
+	// that it starts are counted.
+	at time.Time
+
+	// Track whether caps word is on.
+	capsWord bool
+
+	mouse mouseState
+
+	// Track the dynamic macro being recorded.
+	recording *macroRecording
+
+	// Track the state that each device other than the current one had when
+	// it was switched away from.
+	saved map[string]deviceState
+}
+
+// Define the state that is kept for each device while another device is
+// current. One shot layers and unlocked modifiers are not kept.
+type deviceState struct {
+	layer    layerState
+	lock     lock
+	modLocks [8]bool
 }
 
 func isModifier(key uint8) bool {
@@ -72,7 +144,7 @@ func getModifierIndex(key uint8) uint8 {
 }
 
 func (s *state) releaseModifier(i int) {
-	devices[s.device].writer.releaseDesktop(C.KC_LCTRL + uint8(i))
+	s.output().releaseDesktop(C.KC_LCTRL + uint8(i))
 	s.modifiers[i], s.modLocks[i] = false, false
 }
 
@@ -85,12 +157,12 @@ func (s *state) handleKey(key uint8) {
 		if s.modifiers[i] {
 			s.releaseModifier(int(i))
 		} else {
-			devices[s.device].writer.pressDesktop(key)
+			s.output().pressDesktop(key)
 			s.modifiers[i], s.modLocks[i] = true, s.lock == lockMod
 		}
 	} else {
 		if key != 0 {
-			devices[s.device].writer.pressDesktop(key)
+			s.output().pressDesktop(key)
 
 			// Per https://bit.ly/2Uoy9yG, there must be a minor delay between
 			// pressing and releasing the Caps Lock key on MacOS.
@@ -98,77 +170,265 @@ func (s *state) handleKey(key uint8) {
 				time.Sleep(100 * time.Millisecond)
 			}
 
-			devices[s.device].writer.releaseDesktop(key)
+			s.output().releaseDesktop(key)
 		}
-		for key, value := range s.modifiers {
-			if value && !s.modLocks[key] {
-				s.releaseModifier(key)
+		s.releaseUnlocked()
+	}
+}
+
+func (s *state) releaseUnlocked() {
+	for key, value := range s.modifiers {
+		if value && !s.modLocks[key] {
+			s.releaseModifier(key)
+		}
+	}
+	s.modOwner = nil
+}
+
+// Press a key and return the function that releases it. If the key or the
+// device does not support holding, handle the key right away and return nil.
+// Layer and mouse keys are held regardless of the device since the device does
+// not repeat them.
+func (s *state) pressKey(k key) func() {
+	if h, ok := k.(holdKey); ok && (!devices[s.device].tap || isLayerKey(k) || isMouseKey(k)) {
+		return h.press(s)
+	}
+	k.handle(s)
+	return nil
+}
+
+// Press the desktop key and hold it along with any unlocked modifiers until
+// the returned function is called.
+func (s *state) holdDesktop(key uint8) func() {
+	w := s.output()
+	w.pressDesktop(key)
+	owner := new(bool)
+	s.modOwner = owner
+	return func() {
+		w.releaseDesktop(key)
+		if s.modOwner == owner {
+			s.releaseUnlocked()
+		}
+	}
+}
+
+func (s *state) pressPosition(ev keyEvent) {
+	s.at = ev.at
+
+	// Tap-hold and tap dance keys are handled once they are resolved.
+	switch k := s.lookup(ev.pos).(type) {
+	case tapHoldKey:
+		s.tapHold = &pendingTapHold{pos: ev.pos, key: k, at: ev.at}
+	case tapDanceKey:
+		s.tapDance = &pendingTapDance{pos: ev.pos, key: k, count: 1, down: true, at: ev.at}
+	default:
+		if s.autoShifts(k) {
+			s.autoShift = &pendingAutoShift{pos: ev.pos, key: k.(desktopKey), at: ev.at}
+		} else {
+			s.activateKey(ev.pos, k)
+		}
+	}
+}
+
+// Press k at position j. If key is defined, handle key. Otherwise, treat as
+// 0x00 and reset modifiers. Keys that are part of a leader sequence are not
+// pressed. Keys are adjusted for caps word if it is on and replaced by the key
+// override whose modifiers are active once held keys release theirs.
+func (s *state) activateKey(j int, k key) {
+	s.activateWith(j, k, s.pressKey)
+}
+
+// Hold k at position j as the hold action of a tap-hold or tap dance key. It is
+// otherwise handled like any other key.
+func (s *state) activateHold(j int, k key) {
+	s.activateWith(j, k, s.holdAction)
+}
+
+func (s *state) activateWith(j int, k key, press func(key) func()) {
+	if s.sequence != nil && s.typeSequence(k) {
+		return
+	}
+	k = s.applyCapsWord(k)
+	s.activate(j, func() func() {
+		if k == nil {
+			s.handleKey(0)
+			return nil
+		}
+		return press(s.applyOverride(k))
+	})
+}
+
+// Press the key at position j using press, which returns the function that
+// releases the key, and update the layer and lock accordingly.
+func (s *state) activate(j int, press func() func()) {
+	s.presses++
+
+	// Release modifiers used by a key that is still held so that they do not
+	// apply to this key as well.
+	if s.modOwner != nil {
+		s.releaseUnlocked()
+	}
+	if s.hostRestore != nil {
+		s.hostRestore()
+	}
+
+	layer0, lock0 := s.layer, s.lock
+	s.held[j] = press()
+
+	if layer0 == s.layer {
+		// If the layers have not changed and the user is on a one shot layer,
+		// return to the previous layers.
+		s.clearOneShot()
+
+		// If the lock has not changed, unset it. Having this in the if block
+		// ensures that we can have locks followed by keys that are not on the
+		// default layer.
+		if lock0 == s.lock {
+			s.lock = lockNone
+		}
+	}
+}
+
+func (s *state) releasePosition(j int) {
+	if release := s.held[j]; release != nil {
+		s.held[j] = nil
+		release()
+	}
+}
+
+// Release every held key and drop pending events, for example before the
+// positions change.
+func (s *state) releaseAll() {
+	s.tapHold, s.tapDance, s.queue, s.chord, s.sequence = nil, nil, nil, nil, nil
+	s.autoShift = nil
+	for key := range s.held {
+		s.releasePosition(key)
+	}
+}
+
+// Handle queued events in order until an event must wait for a tap-hold key, a
+// tap dance key, an auto shift key, or a combo to be resolved.
+func (s *state) flush(now time.Time) {
+	for {
+		if p := s.tapHold; p != nil {
+			hold, ok := s.resolveTapHold(now)
+			if !ok {
+				return
+			}
+			s.tapHold, s.at = nil, p.at
+			if hold {
+				s.activateHold(p.pos, p.key.hold)
+			} else {
+				s.activateKey(p.pos, p.key.tap)
+			}
+			continue
+		}
+		if s.tapDance != nil {
+			if !s.resolveTapDance(now) {
+				return
 			}
+			continue
+		}
+		if p := s.autoShift; p != nil {
+			shift, ok := s.resolveAutoShift(now)
+			if !ok {
+				return
+			}
+			s.autoShift, s.at = nil, p.at
+			k := p.key
+			k.shift = shift
+			s.activateKey(p.pos, k)
+			continue
+		}
+
+		if s.chord != nil {
+			if !s.resolveCombo(now) {
+				return
+			}
+			continue
+		}
+
+		// End the leader sequence if it times out before the next event.
+		if s.sequence != nil && (len(s.queue) == 0 && !now.Before(s.sequence.deadline) ||
+			len(s.queue) > 0 && !s.queue[0].at.Before(s.sequence.deadline)) {
+			s.endSequence()
+		}
+
+		if len(s.queue) == 0 {
+			return
+		}
+		ev := s.queue[0]
+		s.queue = s.queue[1:]
+		if ev.down && len(s.comboCandidates(ev.pos)) > 0 {
+			s.chord = []keyEvent{ev}
+		} else if ev.down {
+			s.pressPosition(ev)
+		} else {
+			s.releasePosition(ev.pos)
 		}
 	}
 }
 
-func (s *state) handleEvent(eventChan chan event) {
+// Get a channel that receives when the pending tap-hold key, tap dance key,
+// auto shift key, or combo must be resolved or the leader sequence times out,
+// or nil if there is none.
+func (s *state) timeout() <-chan time.Time {
+	switch {
+	case s.tapHold != nil:
+		return time.After(time.Until(s.tapHold.at.Add(tapping.term())))
+	case s.tapDance != nil:
+		return time.After(time.Until(s.tapDance.at.Add(tapping.term())))
+	case s.autoShift != nil:
+		return time.After(time.Until(s.autoShift.at.Add(autoShift.wait())))
+	case s.chord != nil:
+		return time.After(time.Until(s.chord[0].at.Add(comboTimeout())))
+	case s.sequence != nil:
+		return time.After(time.Until(s.sequence.deadline))
+	}
+	return nil
+}
+
+func (s *state) handleEvent(eventChan chan event, reloadChan chan bool) {
 	for {
-		ev := <-eventChan
+		var ev event
+		select {
+		case ev = <-eventChan:
+		case <-reloadChan:
+			s.reload()
+			continue
+		case now := <-s.timeout():
+			s.flush(now)
+			continue
+		case now := <-s.mouseTimer():
+			s.moveMouse(now)
+			continue
+		}
+		now := time.Now()
+
+		// Ignore input from keyboards other than the two configured halves.
+		if ev.mac != leftMAC && ev.mac != rightMAC {
+			continue
+		}
 
 		// Shift by 8 bits to get rid of the leading 0x01 in the original data.
 		value := binary.LittleEndian.Uint64(ev.data) >> 8
 
-		// On the left hand side, handle the columns in reverse order since the
-		// keymap is defined from top to bottom and left to right. The right
-		// hand side keys should start with an offset of 38.
-		var i, k0, k1, dk int
-		if ev.left {
-			k0, k1, dk = 6, -1, -1
-		} else {
-			i, k0, k1, dk = 38, 0, 7, 1
-		}
-
-		// Store keyboard data in array. Skip keys that do not exist.
-		var keys [76]bool
-		for j := 0; j < 6; j++ {
-			for k := k0; k != k1; k += dk {
-				l := uint(j + 6*k)
-				if l == 2 || l == 4 || l == 10 || l == 41 {
-					continue
-				}
-				keys[i] = value&(1<<l) > 0
-				i++
-			}
+		// Positions on the right half follow those on the left half.
+		half, i := board.Left, 0
+		if ev.mac != leftMAC {
+			half, i = board.Right, board.Left.size()
 		}
 
-		// Detect keys that were just pressed and handle each.
-		for j := i - 38; j < i; j++ {
-			if keys[j] && !s.keys[j] {
-				layer0, lock0 := s.layer, s.lock
-
-				// If key is defined, handle key. Otherwise, treat as 0x00 and
-				// reset modifiers.
-				if k := layers[s.layer][j]; k != nil {
-					k.handle(s)
-				} else {
-					s.handleKey(0)
-				}
-
-				if layer0 == s.layer {
-					// If the layer has not changed and the user is on a one
-					// shot layer, return to the default layer.
-					if layer0 == s.layer && s.layerOSL {
-						s.layer, s.layerOSL = 0, false
-					}
-
-					// If the lock has not changed, unset it. Having this in the
-					// if block ensures that we can have locks followed by keys
-					// that are not on the default layer.
-					if lock0 == s.lock {
-						s.lock = lockNone
-					}
-				}
+		// Detect keys that were just pressed or released and queue each.
+		for key, bit := range half.bits() {
+			j := i + key
+			actuated := value&(1<<bit) > 0
+			if actuated != s.keys[j] {
+				s.queue = append(s.queue, keyEvent{pos: j, down: actuated, at: now})
 			}
-
-			s.keys[j] = keys[j]
+			s.keys[j] = actuated
 		}
+		s.flush(now)
 	}
 }
 
@@ -180,6 +440,6 @@ func handleKeyboard(f *os.File, mac string, eventChan chan event) {
 		if _, err := io.ReadFull(f, data); err != nil {
 			return
 		}
-		eventChan <- event{data: data, left: mac == leftMAC}
+		eventChan <- event{data: data, mac: mac}
 	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Record what the engine sends to a device, with + for presses and - for
+// releases of desktop keys.
+type testWriter struct {
+	log *[]string
+}
+
+func (w testWriter) pressDesktop(code uint8) {
+	*w.log = append(*w.log, "+"+keycodeName(code))
+}
+
+func (w testWriter) releaseDesktop(code uint8) {
+	*w.log = append(*w.log, "-"+keycodeName(code))
+}
+
+func (w testWriter) sendConsumer(usage uint16) {
+	*w.log = append(*w.log, fmt.Sprintf("consumer %#x", usage))
+}
+
+func (w testWriter) sendMouse(buttons uint8, x, y, wheel int8) {
+	*w.log = append(*w.log, fmt.Sprintf("mouse %d %d %d %d", buttons, x, y, wheel))
+}
+
+// Define a press or release of a position at a time in milliseconds. A tick
+// only lets time pass, as when a timeout fires without any input.
+type testEvent struct {
+	at   int
+	pos  int
+	down bool
+	tick bool
+}
+
+func press(at, pos int) testEvent {
+	return testEvent{at: at, pos: pos, down: true}
+}
+
+func release(at, pos int) testEvent {
+	return testEvent{at: at, pos: pos}
+}
+
+func tick(at int) testEvent {
+	return testEvent{at: at, tick: true}
+}
+
+// Make the keymap with layers l current on a single device that holds keys
+// and return a state for it along with the log of what it sends. Tests change
+// the other globals of the keymap as they need.
+func newTestState(l ...layer) (*state, *[]string) {
+	useKeymap(&keymap{
+		layers:    l,
+		tapping:   defaultTapping,
+		comboTerm: defaultComboTerm,
+		leader:    leaderConfig{timeout: defaultLeaderTimeout},
+		autoShift: autoShiftConfig{timeout: defaultAutoShiftTimeout},
+	})
+	log := new([]string)
+	devices = map[string]config{"test": {writer: testWriter{log}, layout: hostLayouts["us"]}}
+	n := len(l[0])
+	return &state{device: "test", keys: make([]bool, n), held: make([]func(), n)}, log
+}
+
+// Queue and handle events the way handleEvent does and return what was sent.
+func runEvents(s *state, log *[]string, events []testEvent) string {
+	start := time.Unix(0, 0)
+	for _, ev := range events {
+		now := start.Add(time.Duration(ev.at) * time.Millisecond)
+		if !ev.tick {
+			s.queue = append(s.queue, keyEvent{pos: ev.pos, down: ev.down, at: now})
+		}
+		s.flush(now)
+	}
+	return strings.Join(*log, " ")
+}
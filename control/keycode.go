@@ -0,0 +1,146 @@
+package main
+
+// #include "keycode.h"
+import "C"
+
+// Map keycode.h names to HID usages so keys can be defined outside of Go code.
+// Only usages on the keyboard page that hosts act on are included.
+var keycodes = map[string]uint8{
+	"KC_A": C.KC_A,
+	"KC_B": C.KC_B,
+	"KC_C": C.KC_C,
+	"KC_D": C.KC_D,
+	"KC_E": C.KC_E,
+	"KC_F": C.KC_F,
+	"KC_G": C.KC_G,
+	"KC_H": C.KC_H,
+	"KC_I": C.KC_I,
+	"KC_J": C.KC_J,
+	"KC_K": C.KC_K,
+	"KC_L": C.KC_L,
+	"KC_M": C.KC_M,
+	"KC_N": C.KC_N,
+	"KC_O": C.KC_O,
+	"KC_P": C.KC_P,
+	"KC_Q": C.KC_Q,
+	"KC_R": C.KC_R,
+	"KC_S": C.KC_S,
+	"KC_T": C.KC_T,
+	"KC_U": C.KC_U,
+	"KC_V": C.KC_V,
+	"KC_W": C.KC_W,
+	"KC_X": C.KC_X,
+	"KC_Y": C.KC_Y,
+	"KC_Z": C.KC_Z,
+	"KC_1": C.KC_1,
+	"KC_2": C.KC_2,
+	"KC_3": C.KC_3,
+	"KC_4": C.KC_4,
+	"KC_5": C.KC_5,
+	"KC_6": C.KC_6,
+	"KC_7": C.KC_7,
+	"KC_8": C.KC_8,
+	"KC_9": C.KC_9,
+	"KC_0": C.KC_0,
+
+	"KC_ENTER":      C.KC_ENTER,
+	"KC_ESCAPE":     C.KC_ESCAPE,
+	"KC_BSPACE":     C.KC_BSPACE,
+	"KC_TAB":        C.KC_TAB,
+	"KC_SPACE":      C.KC_SPACE,
+	"KC_MINUS":      C.KC_MINUS,
+	"KC_EQUAL":      C.KC_EQUAL,
+	"KC_LBRACKET":   C.KC_LBRACKET,
+	"KC_RBRACKET":   C.KC_RBRACKET,
+	"KC_BSLASH":     C.KC_BSLASH,
+	"KC_NONUS_HASH": C.KC_NONUS_HASH,
+	"KC_SCOLON":     C.KC_SCOLON,
+	"KC_QUOTE":      C.KC_QUOTE,
+	"KC_GRAVE":      C.KC_GRAVE,
+	"KC_COMMA":      C.KC_COMMA,
+	"KC_DOT":        C.KC_DOT,
+	"KC_SLASH":      C.KC_SLASH,
+	"KC_CAPSLOCK":   C.KC_CAPSLOCK,
+
+	"KC_F1":  C.KC_F1,
+	"KC_F2":  C.KC_F2,
+	"KC_F3":  C.KC_F3,
+	"KC_F4":  C.KC_F4,
+	"KC_F5":  C.KC_F5,
+	"KC_F6":  C.KC_F6,
+	"KC_F7":  C.KC_F7,
+	"KC_F8":  C.KC_F8,
+	"KC_F9":  C.KC_F9,
+	"KC_F10": C.KC_F10,
+	"KC_F11": C.KC_F11,
+	"KC_F12": C.KC_F12,
+	"KC_F13": C.KC_F13,
+	"KC_F14": C.KC_F14,
+	"KC_F15": C.KC_F15,
+	"KC_F16": C.KC_F16,
+	"KC_F17": C.KC_F17,
+	"KC_F18": C.KC_F18,
+	"KC_F19": C.KC_F19,
+	"KC_F20": C.KC_F20,
+	"KC_F21": C.KC_F21,
+	"KC_F22": C.KC_F22,
+	"KC_F23": C.KC_F23,
+	"KC_F24": C.KC_F24,
+
+	"KC_PSCREEN":    C.KC_PSCREEN,
+	"KC_SCROLLLOCK": C.KC_SCROLLLOCK,
+	"KC_PAUSE":      C.KC_PAUSE,
+	"KC_INSERT":     C.KC_INSERT,
+	"KC_HOME":       C.KC_HOME,
+	"KC_PGUP":       C.KC_PGUP,
+	"KC_DELETE":     C.KC_DELETE,
+	"KC_END":        C.KC_END,
+	"KC_PGDOWN":     C.KC_PGDOWN,
+	"KC_RIGHT":      C.KC_RIGHT,
+	"KC_LEFT":       C.KC_LEFT,
+	"KC_DOWN":       C.KC_DOWN,
+	"KC_UP":         C.KC_UP,
+
+	"KC_NUMLOCK":     C.KC_NUMLOCK,
+	"KC_KP_SLASH":    C.KC_KP_SLASH,
+	"KC_KP_ASTERISK": C.KC_KP_ASTERISK,
+	"KC_KP_MINUS":    C.KC_KP_MINUS,
+	"KC_KP_PLUS":     C.KC_KP_PLUS,
+	"KC_KP_ENTER":    C.KC_KP_ENTER,
+	"KC_KP_1":        C.KC_KP_1,
+	"KC_KP_2":        C.KC_KP_2,
+	"KC_KP_3":        C.KC_KP_3,
+	"KC_KP_4":        C.KC_KP_4,
+	"KC_KP_5":        C.KC_KP_5,
+	"KC_KP_6":        C.KC_KP_6,
+	"KC_KP_7":        C.KC_KP_7,
+	"KC_KP_8":        C.KC_KP_8,
+	"KC_KP_9":        C.KC_KP_9,
+	"KC_KP_0":        C.KC_KP_0,
+	"KC_KP_DOT":      C.KC_KP_DOT,
+	"KC_KP_EQUAL":    C.KC_KP_EQUAL,
+
+	"KC_NONUS_BSLASH": C.KC_NONUS_BSLASH,
+	"KC_APPLICATION":  C.KC_APPLICATION,
+	"KC_POWER":        C.KC_POWER,
+
+	"KC_LCTRL":  C.KC_LCTRL,
+	"KC_LSHIFT": C.KC_LSHIFT,
+	"KC_LALT":   C.KC_LALT,
+	"KC_LGUI":   C.KC_LGUI,
+	"KC_RCTRL":  C.KC_RCTRL,
+	"KC_RSHIFT": C.KC_RSHIFT,
+	"KC_RALT":   C.KC_RALT,
+	"KC_RGUI":   C.KC_RGUI,
+}
+
+// Get the keycode.h name of a HID usage. Return an empty string if the usage
+// is not in keycodes.
+func keycodeName(code uint8) string {
+	for name, value := range keycodes {
+		if value == code {
+			return name
+		}
+	}
+	return ""
+}
@@ -6,31 +6,51 @@ import "C"
 import (
 	"log"
 	"os/exec"
-	"strconv"
+	"unicode"
 )
 
 type key interface {
 	handle(*state)
 }
 
-type layer [76]key
+// Define interface for keys that can be held. The key is pressed by press and
+// released by calling the function it returns, which may be nil if there is
+// nothing to release.
+type holdKey interface {
+	press(*state) func()
+}
+
+type layer []key
 
 // Define key type for switching layers. If a one shot layer key is pressed, the
-// keyboard will reset to the default layer after the subsequent key. This
-// terminology is defined by QMK in https://goo.gl/YK97JN. One shot layers do
-// not need a specific key to cancel input as any undefined key will reset to
-// the default layer.
+// keyboard will reset to the previous layers after the subsequent key. This
+// terminology is defined by QMK in https://goo.gl/YK97JN. See layerMode for
+// the other ways of switching layers.
 type layerKey struct {
 	layer int
-	osl   bool
+	mode  layerMode
 }
 
 type switchKey string
 
 type funcKey func(*state)
 
+// Define key type for running a command. The key must be pressed twice in a row
+// to run the command, which guards against accidentally powering off.
+type commandKey struct {
+	lock lock
+	cmd  string
+	args []string
+}
+
+// Define key type for a key on the keyboard page. Code is the key that types
+// the intended character on a US host and is translated for the layout of the
+// host.
 type desktopKey struct {
-	colemak, qwerty uint8
+	code uint8
+
+	// Set if Shift is forced regardless of the modifiers, as caps word does.
+	shift bool
 }
 
 type consumerKey uint16
@@ -48,14 +68,47 @@ type unicodeKey rune
 
 type unicodeCompoundKey []unicodeKey
 
+// Define key type for an accented or other non-ASCII character that is
+// composed with the compose method of the device. See composeTables for the
+// supported characters.
+type composeKey rune
+
+// Define key type that types text. Characters other than printable ASCII,
+// newline, and tab are typed with a key of the host layout, the compose method
+// of the device, or its Unicode method, whichever supports them first.
 type stringKey string
 
+// Define key type that acts as tap when tapped and as hold when held past the
+// tapping term. This is used for mod-tap keys, which hold a modifier, and
+// layer-tap keys, which switch to a layer until released. See
+// https://docs.qmk.fm/#/tap_hold for the terminology.
+type tapHoldKey struct {
+	tap, hold key
+}
+
+// Define key type whose action depends on how many times it is tapped, with
+// each tap following the previous one within the tapping term. taps[n-1] is
+// the action for n taps and holds[n-1] is the action for holding the key on
+// the nth press. Actions may be nil. See https://docs.qmk.fm/#/feature_tap_dance
+// for the terminology.
+type tapDanceKey struct {
+	taps, holds []key
+}
+
+// Define key type that starts a leader sequence. See
+// https://docs.qmk.fm/#/feature_leader_key for the terminology.
+type leaderKey struct{}
+
+// Define key type that toggles caps word, which shifts letters and types - as _
+// until a key that ends a word.
+type capsWordKey struct{}
+
 var (
 	// Define keys for switching layers.
-	kcLayer0 = layerKey{0, false}
-	kcLayer1 = layerKey{1, true}
-	kcLayer2 = layerKey{2, true}
-	kcLayer3 = layerKey{3, false}
+	kcLayer0 = layerKey{0, layerTo}
+	kcLayer1 = layerKey{1, layerOSL}
+	kcLayer2 = layerKey{2, layerOSL}
+	kcLayer3 = layerKey{3, layerTo}
 
 	// Define keys for switching devices.
 	kcDeviceABC = switchKey("abc123")
@@ -66,6 +119,33 @@ var (
 	kcDeviceMNO = switchKey("mno123")
 	kcDeviceTMP = switchKey("tmp123")
 
+	// Define key that does nothing other than reset modifiers. Unlike an
+	// undefined key, it does not fall through to the layer below.
+	kcNone = funcKey(func(s *state) {
+		s.handleKey(0)
+	})
+
+	// Define key for starting a leader sequence.
+	kcLeader = leaderKey{}
+
+	// Define key for toggling caps word.
+	kcCapsWord = capsWordKey{}
+
+	// Define keys for adjusting auto shift at runtime.
+	kcASUp = funcKey(func(s *state) {
+		s.adjustAutoShift(autoShiftStep)
+	})
+	kcASDown = funcKey(func(s *state) {
+		s.adjustAutoShift(-autoShiftStep)
+	})
+	kcASToggle = funcKey(func(s *state) {
+		autoShift.disabled = !autoShift.disabled
+		s.handleKey(0)
+	})
+	kcASReport = funcKey(func(s *state) {
+		s.reportAutoShift()
+	})
+
 	// Define keys with custom functionality.
 	kcFnModLock = funcKey(func(s *state) {
 		if s.lock == lockMod {
@@ -109,26 +189,26 @@ var (
 	// Define row 2 on the main layer.
 	kcQLower, kcQUpper = keyC(C.KC_Q)
 	kcWLower, kcWUpper = keyC(C.KC_W)
-	kcFLower, kcFUpper = keyCQ(C.KC_F, C.KC_E)
-	kcPLower, kcPUpper = keyCQ(C.KC_P, C.KC_R)
-	kcGLower, kcGUpper = keyCQ(C.KC_G, C.KC_T)
-	kcJLower, kcJUpper = keyCQ(C.KC_J, C.KC_Y)
-	kcLLower, kcLUpper = keyCQ(C.KC_L, C.KC_U)
-	kcULower, kcUUpper = keyCQ(C.KC_U, C.KC_I)
-	kcYLower, kcYUpper = keyCQ(C.KC_Y, C.KC_O)
-	kcSColon, kcColon  = keyCQ(C.KC_SCOLON, C.KC_P)
+	kcFLower, kcFUpper = keyC(C.KC_F)
+	kcPLower, kcPUpper = keyC(C.KC_P)
+	kcGLower, kcGUpper = keyC(C.KC_G)
+	kcJLower, kcJUpper = keyC(C.KC_J)
+	kcLLower, kcLUpper = keyC(C.KC_L)
+	kcULower, kcUUpper = keyC(C.KC_U)
+	kcYLower, kcYUpper = keyC(C.KC_Y)
+	kcSColon, kcColon  = keyC(C.KC_SCOLON)
 
 	// Define row 3 on the main layer.
 	kcALower, kcAUpper = keyC(C.KC_A)
-	kcRLower, kcRUpper = keyCQ(C.KC_R, C.KC_S)
-	kcSLower, kcSUpper = keyCQ(C.KC_S, C.KC_D)
-	kcTLower, kcTUpper = keyCQ(C.KC_T, C.KC_F)
-	kcDLower, kcDUpper = keyCQ(C.KC_D, C.KC_G)
+	kcRLower, kcRUpper = keyC(C.KC_R)
+	kcSLower, kcSUpper = keyC(C.KC_S)
+	kcTLower, kcTUpper = keyC(C.KC_T)
+	kcDLower, kcDUpper = keyC(C.KC_D)
 	kcHLower, kcHUpper = keyC(C.KC_H)
-	kcNLower, kcNUpper = keyCQ(C.KC_N, C.KC_J)
-	kcELower, kcEUpper = keyCQ(C.KC_E, C.KC_K)
-	kcILower, kcIUpper = keyCQ(C.KC_I, C.KC_L)
-	kcOLower, kcOUpper = keyCQ(C.KC_O, C.KC_SCOLON)
+	kcNLower, kcNUpper = keyC(C.KC_N)
+	kcELower, kcEUpper = keyC(C.KC_E)
+	kcILower, kcIUpper = keyC(C.KC_I)
+	kcOLower, kcOUpper = keyC(C.KC_O)
 
 	// Define row 4 on the main layer.
 	kcZLower, kcZUpper = keyC(C.KC_Z)
@@ -136,7 +216,7 @@ var (
 	kcCLower, kcCUpper = keyC(C.KC_C)
 	kcVLower, kcVUpper = keyC(C.KC_V)
 	kcBLower, kcBUpper = keyC(C.KC_B)
-	kcKLower, kcKUpper = keyCQ(C.KC_K, C.KC_N)
+	kcKLower, kcKUpper = keyC(C.KC_K)
 	kcMLower, kcMUpper = keyC(C.KC_M)
 	kcComma, kcLAngle  = keyC(C.KC_COMMA)
 	kcDot, kcRAngle    = keyC(C.KC_DOT)
@@ -180,33 +260,49 @@ var (
 	kcInsert = keyD(C.KC_INSERT)
 	kcPageDn = keyD(C.KC_PGDOWN)
 
+	// Define keys for dynamic macros.
+	kcMacroRec0  = macroKey{macroRecord, 0}
+	kcMacroRec1  = macroKey{macroRecord, 1}
+	kcMacroStop  = macroKey{macroStop, 0}
+	kcMacroPlay0 = macroKey{macroPlay, 0}
+	kcMacroPlay1 = macroKey{macroPlay, 1}
+
+	// Define mouse keys. See mouseKey for how the pointer moves.
+	kcMsBtn1  = mouseKey{buttons: 1 << 0}
+	kcMsBtn2  = mouseKey{buttons: 1 << 1}
+	kcMsBtn3  = mouseKey{buttons: 1 << 2}
+	kcMsUp    = mouseKey{y: -1}
+	kcMsDown  = mouseKey{y: 1}
+	kcMsLeft  = mouseKey{x: -1}
+	kcMsRight = mouseKey{x: 1}
+	kcWhUp    = mouseKey{wheel: 1}
+	kcWhDown  = mouseKey{wheel: -1}
+
+	// Define platform-aware shortcuts. See shortcuts for their chords.
+	kcCopy      = shortcutKey("copy")
+	kcPaste     = shortcutKey("paste")
+	kcUndo      = shortcutKey("undo")
+	kcRedo      = shortcutKey("redo")
+	kcSelWordL  = shortcutKey("select-word-left")
+	kcDelWord   = shortcutKey("delete-word")
+	kcLockScrn  = shortcutKey("lock-screen")
+	kcSwitchApp = shortcutKey("switch-app")
+	kcNewTab    = shortcutKey("new-tab")
+	kcScrnShot  = shortcutKey("screenshot")
+
 	// Define shortcuts for Firefox.
 	kcFFMenu = virtualKey{kcLCtrl, kcLLower, kcLShift, kcTab, kcLShift, kcTab, kcApp}
 
-	// Define Spanish accented vowels.
-	kcATilde = keyESTilde(kcALower)
-	kcETilde = keyESTilde(kcELower)
-	kcITilde = keyESTilde(kcILower)
-	kcOTilde = keyESTilde(kcOLower)
-	kcUTilde = keyESTilde(kcULower)
-
-	// Define additional Spanish characters.
-	kcNTilde = intlKey{
-		stdKey: virtualKey{kcRAlt, kcNLower},
-		macKey: virtualKey{kcLAlt, kcNLower, kcNLower},
-	}
-	kcUDier = intlKey{
-		stdKey: virtualKey{kcRAlt, kcYLower},
-		macKey: virtualKey{kcLAlt, kcULower, kcULower},
-	}
-	kcExclInv = intlKey{
-		stdKey: virtualKey{kcRAlt, kcLShift, kc1},
-		macKey: virtualKey{kcLAlt, kc1},
-	}
-	kcQuesInv = intlKey{
-		stdKey: virtualKey{kcRAlt, kcSlash},
-		macKey: virtualKey{kcLAlt, kcLShift, kcSlash},
-	}
+	// Define Spanish characters. See composeTables for how they are typed.
+	kcATilde  = composeKey('á')
+	kcETilde  = composeKey('é')
+	kcITilde  = composeKey('í')
+	kcOTilde  = composeKey('ó')
+	kcUTilde  = composeKey('ú')
+	kcNTilde  = composeKey('ñ')
+	kcUDier   = composeKey('ü')
+	kcExclInv = composeKey('¡')
+	kcQuesInv = composeKey('¿')
 
 	// Define emojis.
 	kcEmGrin  = unicodeKey(0x1f604)
@@ -236,7 +332,7 @@ var asciiTable ['~' + 1 - ' ']key = [...]key{
 	kcXLower, kcYLower, kcZLower, kcLBrace, kcPipe, kcRBrace, kcTilde,
 }
 
-var layers []layer = []layer{
+var defaultLayers = []layer{
 	// Define main layer.
 	{
 		nil, kc1, kc2, kc3, kc4, kc5, kcPrtScn,
@@ -257,117 +353,213 @@ var layers []layer = []layer{
 	// function keys are not given their own variable since they are simple to
 	// define and not need elsewhere.
 	{
-		nil, kcDeviceABC, kcDeviceDEF, kcDeviceGHI, kcDeviceJKL, kcDeviceUIN, nil,
-		nil, keyD(C.KC_F1), keyD(C.KC_F2), keyD(C.KC_F3), keyD(C.KC_F4), nil, nil,
-		nil, keyD(C.KC_F5), keyD(C.KC_F6), keyD(C.KC_F7), keyD(C.KC_F8), nil,
-		nil, keyD(C.KC_F9), keyD(C.KC_F10), keyD(C.KC_F11), keyD(C.KC_F12), nil, nil,
-		nil, nil, nil, nil, nil,
-		nil, nil, kcFnTmpReset, kcDeviceTMP, nil, nil,
-		nil, kcDeviceMNO, nil, nil, nil, nil, nil,
-		nil, nil, keyD(C.KC_F13), keyD(C.KC_F14), keyD(C.KC_F15), keyD(C.KC_F16), nil,
-		nil, keyD(C.KC_F17), keyD(C.KC_F18), keyD(C.KC_F19), keyD(C.KC_F20), nil,
-		nil, nil, keyD(C.KC_F21), keyD(C.KC_F22), keyD(C.KC_F23), keyD(C.KC_F24), nil,
-		nil, nil, nil, nil, nil,
-		nil, nil, nil, nil, nil, nil,
+		kcNone, kcDeviceABC, kcDeviceDEF, kcDeviceGHI, kcDeviceJKL, kcDeviceUIN, kcNone,
+		kcNone, keyD(C.KC_F1), keyD(C.KC_F2), keyD(C.KC_F3), keyD(C.KC_F4), kcNone, kcNone,
+		kcNone, keyD(C.KC_F5), keyD(C.KC_F6), keyD(C.KC_F7), keyD(C.KC_F8), kcNone,
+		kcNone, keyD(C.KC_F9), keyD(C.KC_F10), keyD(C.KC_F11), keyD(C.KC_F12), kcNone, kcNone,
+		kcNone, kcNone, kcNone, kcNone, kcNone,
+		kcNone, kcNone, kcFnTmpReset, kcDeviceTMP, kcNone, kcNone,
+		kcNone, kcDeviceMNO, kcNone, kcNone, kcNone, kcNone, kcNone,
+		kcNone, kcNone, keyD(C.KC_F13), keyD(C.KC_F14), keyD(C.KC_F15), keyD(C.KC_F16), kcNone,
+		kcNone, keyD(C.KC_F17), keyD(C.KC_F18), keyD(C.KC_F19), keyD(C.KC_F20), kcNone,
+		kcNone, kcNone, keyD(C.KC_F21), keyD(C.KC_F22), keyD(C.KC_F23), keyD(C.KC_F24), kcNone,
+		kcNone, kcNone, kcNone, kcNone, kcNone,
+		kcNone, kcNone, kcNone, kcNone, kcNone, kcNone,
 	},
 
 	// Define layer for additional characters.
 	{
-		kcFnPowerOff, kcEmGrin, kcEmCry, kcEmJoy, kcEmSweat, kcEmSmile, nil,
-		nil, nil, kcExclInv, kcTilde, kcGrave, kcHash, nil,
-		nil, kcATilde, kcExclam, kcPlus, kcEqual, kcDollar,
-		nil, kcQuesInv, kcAt, kcLBrack, kcRBrack, kcPrcnt, nil,
-		nil, nil, nil, nil, nil,
-		nil, nil, kcDQuote, kcQuote, nil, nil,
-		nil, kcEmThumb, kcEmThink, kcEmWink, kcEmPout, kcEmFPalm, kcFnReboot,
-		nil, kcCaret, kcUDier, kcUTilde, nil, nil, nil,
-		kcAmper, kcNTilde, kcETilde, kcITilde, kcOTilde, nil,
-		nil, kcAstrsk, kcMinus, kcUnders, kcLBrace, kcRBrace, nil,
-		nil, nil, nil, nil, nil,
-		nil, nil, kcRParen, kcLParen, nil, nil,
+		kcFnPowerOff, kcEmGrin, kcEmCry, kcEmJoy, kcEmSweat, kcEmSmile, kcNone,
+		kcNone, kcNone, kcExclInv, kcTilde, kcGrave, kcHash, kcNone,
+		kcNone, kcATilde, kcExclam, kcPlus, kcEqual, kcDollar,
+		kcNone, kcQuesInv, kcAt, kcLBrack, kcRBrack, kcPrcnt, kcNone,
+		kcNone, kcNone, kcNone, kcNone, kcNone,
+		kcNone, kcNone, kcDQuote, kcQuote, kcNone, kcNone,
+		kcNone, kcEmThumb, kcEmThink, kcEmWink, kcEmPout, kcEmFPalm, kcFnReboot,
+		kcNone, kcCaret, kcUDier, kcUTilde, kcNone, kcNone, kcNone,
+		kcAmper, kcNTilde, kcETilde, kcITilde, kcOTilde, kcNone,
+		kcNone, kcAstrsk, kcMinus, kcUnders, kcLBrace, kcRBrace, kcNone,
+		kcNone, kcNone, kcNone, kcNone, kcNone,
+		kcNone, kcNone, kcRParen, kcLParen, kcNone, kcNone,
 	},
 
 	// Define number pad layer.
 	{
-		nil, nil, nil, nil, nil, nil, nil,
-		kcTab, nil, nil, nil, nil, nil, nil,
-		nil, kcSlash, kcAstrsk, kcMinus, kcPlus, nil,
-		nil, nil, nil, kcEqual, kcDot, nil, nil,
-		nil, nil, nil, nil, nil,
-		nil, nil, kcLCtrl, kcSpace, nil, nil,
-		nil, nil, nil, nil, nil, nil, nil,
-		nil, nil, kc7, kc8, kc9, kcColon, nil,
-		nil, kc4, kc5, kc6, kc0, kcBspace,
-		nil, nil, kc1, kc2, kc3, nil, nil,
-		nil, nil, nil, nil, kcLayer0,
-		nil, nil, kcEnter, kcLShift, nil, nil,
+		kcNone, kcNone, kcNone, kcNone, kcNone, kcNone, kcNone,
+		kcTab, kcNone, kcNone, kcNone, kcNone, kcNone, kcNone,
+		kcNone, kcSlash, kcAstrsk, kcMinus, kcPlus, kcNone,
+		kcNone, kcNone, kcNone, kcEqual, kcDot, kcNone, kcNone,
+		kcNone, kcNone, kcNone, kcNone, kcNone,
+		kcNone, kcNone, kcLCtrl, kcSpace, kcNone, kcNone,
+		kcNone, kcNone, kcNone, kcNone, kcNone, kcNone, kcNone,
+		kcNone, kcNone, kc7, kc8, kc9, kcColon, kcNone,
+		kcNone, kc4, kc5, kc6, kc0, kcBspace,
+		kcNone, kcNone, kc1, kc2, kc3, kcNone, kcNone,
+		kcNone, kcNone, kcNone, kcNone, kcLayer0,
+		kcNone, kcNone, kcEnter, kcLShift, kcNone, kcNone,
 	},
 }
 
-func (k layerKey) handle(s *state) {
-	s.layer, s.layerOSL = k.layer, k.osl
-}
-
 func (k switchKey) handle(s *state) {
-	// Reset all active modifiers.
+	// Release every held key and modifier so that none is left pressed on the
+	// host of the current device. Held keys are released before the state is
+	// saved so that momentary layers are not saved. Device switches are not
+	// part of macros.
+	recording := s.recording
+	s.recording = nil
+	for key := range s.held {
+		s.releasePosition(key)
+	}
+	saved := deviceState{layer: s.layer, lock: s.lock, modLocks: s.modLocks}
+	saved.layer.active &^= saved.layer.oneShot
+	saved.layer.oneShot = 0
 	for key, value := range s.modifiers {
 		if value {
 			s.releaseModifier(key)
 		}
 	}
+	s.recording = recording
+	if s.saved == nil {
+		s.saved = make(map[string]deviceState)
+	}
+	s.saved[s.device] = saved
 
-	// Update device.
+	// Update device and restore its state, pressing its locked modifiers
+	// again. The layers of the new device may differ, so reset them if any
+	// active layer does not exist on the new device.
 	s.device = string(k)
+	restored := s.saved[s.device]
+	delete(s.saved, s.device)
+	s.layer, s.lock = restored.layer, restored.lock
+	for key, value := range restored.modLocks {
+		if value {
+			s.output().pressDesktop(C.KC_LCTRL + uint8(key))
+			s.modifiers[key], s.modLocks[key] = true, true
+		}
+	}
+	if !s.layer.valid(len(s.keymapLayers())) {
+		s.layer = layerState{}
+	}
 }
 
 func (k funcKey) handle(s *state) {
 	k(s)
 }
 
-func (k desktopKey) handle(s *state) {
-	if devices[s.device].qwerty && k.qwerty != 0 {
-		s.handleKey(k.qwerty)
+func (k commandKey) handle(s *state) {
+	if s.lock == k.lock {
+		if err := exec.Command(k.cmd, k.args...).Run(); err != nil {
+			log.Fatal(err)
+		}
 	} else {
-		s.handleKey(k.colemak)
+		s.lock = k.lock
+	}
+}
+
+func (k desktopKey) handle(s *state) {
+	// Modifiers type the same key on every host and are recorded as is.
+	if isModifier(k.code) && !k.shift {
+		s.handleKey(k.code)
+		return
+	}
+	code := k.code
+	s.recordAs(func() {
+		s.typeHostKey(s.hostKey(k.code, k.shift))
+	}, macroEvent{Press: &code, Shift: k.shift}, macroEvent{Release: &code})
+}
+
+func (k desktopKey) press(s *state) func() {
+	// Modifiers toggle while the modifier lock is set or if they are already
+	// active so that they can be locked and unlocked. Otherwise, they are held
+	// down for as long as the key is if another key is pressed meanwhile. If
+	// not, they apply to the next key like a tapped modifier.
+	if isModifier(k.code) {
+		i := getModifierIndex(k.code)
+		if s.lock == lockMod || s.modifiers[i] {
+			s.handleKey(k.code)
+			return nil
+		}
+		presses := s.presses
+		release := s.holdAction(k)
+		return func() {
+			if s.presses == presses && s.modifiers[i] {
+				s.modLocks[i] = false
+				return
+			}
+			release()
+		}
+	}
+	code := k.code
+	var release, restore func()
+	s.recordAs(func() {
+		h := s.hostKey(k.code, k.shift)
+		restore = s.hostModifiers(h)
+		release = s.holdDesktop(h.code)
+	}, macroEvent{Press: &code, Shift: k.shift})
+	var restored bool
+	restoreOnce := func() {
+		if !restored {
+			restored = true
+			s.hostRestore = nil
+			s.recordAs(restore)
+		}
+	}
+	s.hostRestore = restoreOnce
+	return func() {
+		s.recordAs(func() {
+			release()
+			restoreOnce()
+		}, macroEvent{Release: &code})
 	}
 }
 
 func (k consumerKey) handle(s *state) {
 	// Send using consumer report. Send 0x00 key to reset modifiers if
 	// appropriate.
-	devices[s.device].writer.sendConsumer(uint16(k))
-	devices[s.device].writer.sendConsumer(0)
+	s.output().sendConsumer(uint16(k))
+	s.output().sendConsumer(0)
 	s.handleKey(0)
 }
 
+func (k consumerKey) press(s *state) func() {
+	w := s.output()
+	w.sendConsumer(uint16(k))
+	s.handleKey(0)
+	return func() {
+		w.sendConsumer(0)
+	}
+}
+
 func (k virtualKey) handle(s *state) {
 	for _, value := range k {
 		value.handle(s)
 	}
 }
 
-func (k intlKey) handle(s *state) {
+func (k intlKey) platformKey(s *state) key {
 	// This expects Android, Linux, and Windows to have an international
-	// keyboard with AltGr support. The default layout is fine on MacOS. There
-	// is no default cause since the cases are exhaustive.
-	switch devices[s.device].platform {
-	case platAndroid, platLinux, platWindows:
-		k.stdKey.handle(s)
-	case platMacOS:
-		k.macKey.handle(s)
+	// keyboard with AltGr support. The default layout is fine on MacOS.
+	if devices[s.device].platform == platMacOS {
+		return k.macKey
 	}
+	return k.stdKey
+}
+
+func (k intlKey) handle(s *state) {
+	k.platformKey(s).handle(s)
+}
+
+func (k intlKey) press(s *state) func() {
+	return s.pressKey(k.platformKey(s))
 }
 
 func (k unicodeKey) handle(s *state) {
-	// Input Unicode character with Ctrl-Shuft-U on Linux. On other platforms,
-	// treat as no-op and reset modifiers.
-	if devices[s.device].platform == platLinux {
-		virtualKey{kcLCtrl, kcLShift, kcULower}.handle(s)
-		stringKey(strconv.FormatInt(int64(k), 16)).handle(s)
-		kcSpace.handle(s)
-	} else {
-		s.handleKey(0)
-	}
+	// Input Unicode character with the method of the device. If the device has
+	// no method, treat as no-op and reset modifiers.
+	r := rune(k)
+	s.recordAs(func() {
+		devices[s.device].unicode.input(s, r)
+	}, macroEvent{Char: &r})
 }
 
 func (k unicodeCompoundKey) handle(s *state) {
@@ -381,6 +573,8 @@ func (k unicodeCompoundKey) handle(s *state) {
 }
 
 func (k stringKey) handle(s *state) {
+	// Characters that cannot be typed on the device are skipped.
+	d := devices[s.device]
 	for _, value := range k {
 		switch {
 		case value >= ' ' && value <= '~':
@@ -389,39 +583,73 @@ func (k stringKey) handle(s *state) {
 			kcEnter.handle(s)
 		case value == '\t':
 			kcTab.handle(s)
+		case d.canType(value):
+			composeKey(value).handle(s)
 		}
 	}
 }
 
-func keyCommand(l lock, cmd string, args ...string) funcKey {
-	return funcKey(func(s *state) {
-		if s.lock == l {
-			if err := exec.Command(cmd, args...).Run(); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			s.lock = l
+// Check whether r can be typed on the device. Control characters other than
+// newline and tab cannot be typed.
+func (c config) canType(r rune) bool {
+	switch {
+	case r >= ' ' && r <= '~' || r == '\n' || r == '\t':
+		return true
+	case c.layout.keys[r] != (hostKey{}) || c.compose.sequence(r) != nil:
+		return true
+	case unicode.IsControl(r):
+		return false
+	}
+	return c.unicode.canInput(r)
+}
+
+// Find the characters of k that cannot be typed on the device, in the order
+// they first appear.
+func (k stringKey) untypable(c config) []rune {
+	var runes []rune
+	seen := make(map[rune]bool)
+	for _, value := range k {
+		if !c.canType(value) && !seen[value] {
+			runes = append(runes, value)
+			seen[value] = true
 		}
-	})
+	}
+	return runes
 }
 
-func keyD(code uint8) desktopKey {
-	return desktopKey{colemak: code}
+func (k tapHoldKey) handle(s *state) {
+	// Tap-hold keys are resolved by the event loop. Keys that are handled
+	// directly, such as within a virtualKey, are treated as a tap.
+	k.tap.handle(s)
 }
 
-func keyC(colemak uint8) (desktopKey, virtualKey) {
-	return keyCQ(colemak, 0)
+func (k tapDanceKey) handle(s *state) {
+	// Keys that are handled directly are treated as a single tap.
+	if t := k.tap(1); t != nil {
+		t.handle(s)
+	} else {
+		s.handleKey(0)
+	}
+}
+
+func keyCommand(l lock, cmd string, args ...string) commandKey {
+	return commandKey{lock: l, cmd: cmd, args: args}
+}
+
+func keyD(code uint8) desktopKey {
+	return desktopKey{code: code}
 }
 
-func keyCQ(colemak, qwerty uint8) (desktopKey, virtualKey) {
-	base := desktopKey{colemak: colemak, qwerty: qwerty}
+func keyC(code uint8) (desktopKey, virtualKey) {
+	base := keyD(code)
 	shifted := virtualKey{kcLShift, base}
 	return base, shifted
 }
 
-func keyESTilde(vowel key) intlKey {
-	return intlKey{
-		stdKey: virtualKey{kcRAlt, vowel},
-		macKey: virtualKey{kcLAlt, kcELower, vowel},
-	}
+func keyMT(modifier desktopKey, tap key) tapHoldKey {
+	return tapHoldKey{tap: tap, hold: modifier}
+}
+
+func keyLT(layer int, tap key) tapHoldKey {
+	return tapHoldKey{tap: tap, hold: layerKey{layer: layer, mode: layerMomentary}}
 }
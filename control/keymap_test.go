@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Test that a modifier key applies to the next key when it is tapped and is
+// held down like on a desktop keyboard when another key is pressed meanwhile.
+func TestModifierKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []testEvent
+		want   string
+	}{
+		{
+			name:   "tap then key",
+			events: []testEvent{press(0, 0), release(10, 0), press(20, 1), release(30, 1)},
+			want:   "+KC_LCTRL +KC_C -KC_C -KC_LCTRL",
+		},
+		{
+			name:   "tap applies to one key",
+			events: []testEvent{press(0, 0), release(10, 0), press(20, 1), release(30, 1), press(40, 1), release(50, 1)},
+			want:   "+KC_LCTRL +KC_C -KC_C -KC_LCTRL +KC_C -KC_C",
+		},
+		{
+			name:   "tap twice",
+			events: []testEvent{press(0, 0), release(10, 0), press(20, 0), release(30, 0), press(40, 1), release(50, 1)},
+			want:   "+KC_LCTRL -KC_LCTRL +KC_C -KC_C",
+		},
+		{
+			name:   "hold then key",
+			events: []testEvent{press(0, 0), press(20, 1), release(30, 1), press(40, 1), release(50, 1), release(60, 0)},
+			want:   "+KC_LCTRL +KC_C -KC_C +KC_C -KC_C -KC_LCTRL",
+		},
+		{
+			name:   "released before key",
+			events: []testEvent{press(0, 0), press(20, 1), release(30, 0), release(40, 1), press(50, 1), release(60, 1)},
+			want:   "+KC_LCTRL +KC_C -KC_LCTRL -KC_C +KC_C -KC_C",
+		},
+	}
+	for _, test := range tests {
+		s, log := newTestState(layer{kcLCtrl, kcCLower})
+		if got := runEvents(s, log, test.events); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// Test that switching devices releases what is held on the device switched
+// away from and restores its layers and locked modifiers when switching back.
+func TestSwitchDevice(t *testing.T) {
+	s, log := newTestState(
+		layer{switchKey("other"), switchKey("test"), layerKey{1, layerToggle}, kcFnModLock, kcLCtrl, kcALower},
+		layer{nil, nil, nil, nil, nil, kcBLower},
+	)
+	other := new([]string)
+	devices["other"] = config{writer: testWriter{other}}
+	runEvents(s, log, []testEvent{
+		press(0, 2), release(10, 2),
+		press(20, 3), release(30, 3),
+		press(40, 4), release(50, 4),
+		press(60, 5),
+		press(70, 0), release(80, 0),
+		release(90, 5),
+		press(100, 5), release(110, 5),
+		press(120, 1), release(130, 1),
+		press(140, 5), release(150, 5),
+	})
+	if got, want := strings.Join(*log, " "), "+KC_LCTRL +KC_B -KC_B -KC_LCTRL +KC_LCTRL +KC_B -KC_B"; got != want {
+		t.Errorf("test: got %q, want %q", got, want)
+	}
+	if got, want := strings.Join(*other, " "), "+KC_A -KC_A"; got != want {
+		t.Errorf("other: got %q, want %q", got, want)
+	}
+}
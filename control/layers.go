@@ -0,0 +1,139 @@
+package main
+
+import "fmt"
+
+// Layers are tracked in bit fields, which limits the number of layers.
+const maxLayers = 32
+
+type layerMode int
+
+// Define what a layerKey does, following the QMK layer keys of the same names.
+// See https://docs.qmk.fm/#/feature_layers for the terminology.
+const (
+	// Activate the layer and deactivate every other layer but the default
+	// layer.
+	layerTo layerMode = iota
+
+	// Activate the layer for the next key that does not change the layers.
+	layerOSL
+
+	// Activate the layer while the key is held.
+	layerMomentary
+
+	// Activate the layer if it is not active and deactivate it otherwise.
+	layerToggle
+
+	// Make the layer the default layer.
+	layerDefault
+)
+
+var layerModes = map[string]layerMode{
+	"to":        layerTo,
+	"osl":       layerOSL,
+	"momentary": layerMomentary,
+	"toggle":    layerToggle,
+	"default":   layerDefault,
+}
+
+// Track the active layers. The default layer is always active. Active and
+// oneShot are bit fields of the other active layers and of those that are only
+// active for the next key. Keys are looked up from the highest active layer
+// down, with undefined keys falling through to the next active layer.
+type layerState struct {
+	base    int
+	active  uint32
+	oneShot uint32
+}
+
+func parseLayerMode(name string) (layerMode, error) {
+	mode, ok := layerModes[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown layer mode %q", name)
+	}
+	return mode, nil
+}
+
+func validateLayerCount(n int) error {
+	if n > maxLayers {
+		return fmt.Errorf("%d layers, expected at most %d", n, maxLayers)
+	}
+	return nil
+}
+
+func (l layerState) bits() uint32 {
+	return l.active | 1<<uint(l.base)
+}
+
+// Get the highest active layer.
+func (l layerState) top() int {
+	for i := maxLayers - 1; i > 0; i-- {
+		if l.bits()&(1<<uint(i)) != 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// Check that every active layer exists.
+func (l layerState) valid(n int) bool {
+	return l.bits()>>uint(n) == 0
+}
+
+// Get the layers of the current device, which are the layers of the keymap
+// unless the device overrides them.
+func (s *state) keymapLayers() []layer {
+	if l, ok := deviceLayers[s.device]; ok {
+		return l
+	}
+	return layers
+}
+
+// Find the key at position j on the highest active layer that defines it.
+func (s *state) lookup(j int) key {
+	l := s.keymapLayers()
+	bits := s.layer.bits()
+	for i := len(l) - 1; i >= 0; i-- {
+		if bits&(1<<uint(i)) != 0 && l[i][j] != nil {
+			return l[i][j]
+		}
+	}
+	return nil
+}
+
+// Deactivate one shot layers once a key that does not change the layers is
+// pressed.
+func (s *state) clearOneShot() {
+	s.layer.active &^= s.layer.oneShot
+	s.layer.oneShot = 0
+}
+
+func (k layerKey) handle(s *state) {
+	bit := uint32(1) << uint(k.layer)
+	switch k.mode {
+	case layerTo:
+		s.layer.active, s.layer.oneShot = bit, 0
+	case layerOSL, layerMomentary:
+		// Momentary layer keys that cannot be held act as one shot layer
+		// keys.
+		s.layer.active |= bit
+		s.layer.oneShot |= bit
+	case layerToggle:
+		s.layer.active ^= bit
+		s.layer.oneShot &^= bit
+	case layerDefault:
+		s.layer.base = k.layer
+	}
+}
+
+func (k layerKey) press(s *state) func() {
+	if k.mode != layerMomentary {
+		k.handle(s)
+		return nil
+	}
+	bit := uint32(1) << uint(k.layer)
+	s.layer.active |= bit
+	s.layer.oneShot &^= bit
+	return func() {
+		s.layer.active &^= bit
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+// Test the layer keys on a keymap whose second layer leaves every position but
+// the one of A transparent.
+func TestLayerKeys(t *testing.T) {
+	base := layer{
+		layerKey{1, layerMomentary},
+		layerKey{1, layerOSL},
+		layerKey{1, layerToggle},
+		layerKey{2, layerDefault},
+		kcALower,
+		kcDLower,
+	}
+	tests := []struct {
+		name   string
+		events []testEvent
+		want   string
+	}{
+		{
+			name:   "momentary",
+			events: []testEvent{press(0, 0), press(10, 4), release(20, 4), release(30, 0), press(40, 4), release(50, 4)},
+			want:   "+KC_B -KC_B +KC_A -KC_A",
+		},
+		{
+			name:   "transparent",
+			events: []testEvent{press(0, 0), press(10, 5), release(20, 5), release(30, 0)},
+			want:   "+KC_D -KC_D",
+		},
+		{
+			name:   "one shot",
+			events: []testEvent{press(0, 1), release(10, 1), press(20, 4), release(30, 4), press(40, 4), release(50, 4)},
+			want:   "+KC_B -KC_B +KC_A -KC_A",
+		},
+		{
+			name:   "toggle",
+			events: []testEvent{press(0, 2), release(10, 2), press(20, 4), release(30, 4), press(40, 4), release(50, 4), press(60, 2), release(70, 2), press(80, 4), release(90, 4)},
+			want:   "+KC_B -KC_B +KC_B -KC_B +KC_A -KC_A",
+		},
+		{
+			name:   "default",
+			events: []testEvent{press(0, 3), release(10, 3), press(20, 4), release(30, 4), press(40, 5), release(50, 5), press(60, 3), release(70, 3), press(80, 4), release(90, 4)},
+			want:   "+KC_C -KC_C +KC_C -KC_C +KC_A -KC_A",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, log := newTestState(
+				base,
+				layer{nil, nil, nil, nil, kcBLower, nil},
+				layer{nil, nil, nil, layerKey{0, layerDefault}, kcCLower, kcCLower},
+			)
+			if got := runEvents(s, log, tt.events); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+// #include "keycode.h"
+import "C"
+
+// Define the keys whose characters depend on the layout of the host, in the
+// order in which hostLayout lists their characters.
+var layoutCodes = [...]uint8{
+	C.KC_A, C.KC_B, C.KC_C, C.KC_D, C.KC_E, C.KC_F, C.KC_G, C.KC_H, C.KC_I,
+	C.KC_J, C.KC_K, C.KC_L, C.KC_M, C.KC_N, C.KC_O, C.KC_P, C.KC_Q, C.KC_R,
+	C.KC_S, C.KC_T, C.KC_U, C.KC_V, C.KC_W, C.KC_X, C.KC_Y, C.KC_Z,
+	C.KC_1, C.KC_2, C.KC_3, C.KC_4, C.KC_5, C.KC_6, C.KC_7, C.KC_8, C.KC_9,
+	C.KC_0, C.KC_MINUS, C.KC_EQUAL, C.KC_LBRACKET, C.KC_RBRACKET, C.KC_BSLASH,
+	C.KC_NONUS_HASH, C.KC_SCOLON, C.KC_QUOTE, C.KC_GRAVE, C.KC_COMMA,
+	C.KC_DOT, C.KC_SLASH, C.KC_NONUS_BSLASH,
+}
+
+// Define a key on the host along with the modifiers that it requires.
+type hostKey struct {
+	code         uint8
+	shift, altGr bool
+}
+
+// Define the characters typed by each key on a host layout. The keymap is
+// written for a US host, so keys are translated into the keys that type the
+// same characters on the host.
+type hostLayout struct {
+	keys  map[rune]hostKey
+	chars map[hostKey]rune
+}
+
+// Create a host layout from the characters typed by the keys of layoutCodes
+// without and with Shift, with a space for keys that type no character or a
+// dead key, and from the characters typed with AltGr.
+func newHostLayout(normal, shifted string, altGr map[rune]uint8) hostLayout {
+	l := hostLayout{keys: make(map[rune]hostKey), chars: make(map[hostKey]rune)}
+	add := func(r rune, k hostKey) {
+		if r == ' ' {
+			return
+		}
+		if _, ok := l.keys[r]; !ok {
+			l.keys[r] = k
+		}
+		l.chars[k] = r
+	}
+	for key, value := range []rune(normal) {
+		add(value, hostKey{code: layoutCodes[key]})
+	}
+	for key, value := range []rune(shifted) {
+		add(value, hostKey{code: layoutCodes[key], shift: true})
+	}
+	for key, value := range altGr {
+		add(key, hostKey{code: value, altGr: true})
+	}
+	return l
+}
+
+// Define the supported host layouts. These follow the layouts of Linux and
+// Windows, which may differ in their AltGr characters from those of MacOS.
+var hostLayouts = map[string]hostLayout{
+	"us": newHostLayout(
+		"abcdefghijklmnopqrstuvwxyz1234567890-=[]\\ ;'`,./ ",
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ!@#$%^&*()_+{}| :\"~<>? ",
+		nil,
+	),
+	"uk": newHostLayout(
+		"abcdefghijklmnopqrstuvwxyz1234567890-=[] #;'`,./\\",
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ!\"£$%^&*()_+{} ~:@¬<>?|",
+		map[rune]uint8{'€': C.KC_4},
+	),
+	"colemak": newHostLayout(
+		"abcsftdhuneimky;qprglvwxjz1234567890-=[]\\ o'`,./ ",
+		"ABCSFTDHUNEIMKY:QPRGLVWXJZ!@#$%^&*()_+{}| O\"~<>? ",
+		nil,
+	),
+	"dvorak": newHostLayout(
+		"axje.uidchtnmbrl'poygk,qf;1234567890[]/=\\ s-`wvz ",
+		"AXJE>UIDCHTNMBRL\"POYGK<QF:!@#$%^&*(){}?+| S_~WVZ ",
+		nil,
+	),
+	"azerty": newHostLayout(
+		"qbcdefghijkl,nopartsuvzxyw&é\"'(-è_çà)= $ *mù²;:!<",
+		"QBCDEFGHIJKL?NOPARTSUVZXYW1234567890°+ £ µM% ./§>",
+		map[rune]uint8{
+			'#': C.KC_3, '{': C.KC_4, '[': C.KC_5, '|': C.KC_6, '\\': C.KC_8,
+			'^': C.KC_9, '@': C.KC_0, ']': C.KC_MINUS, '}': C.KC_EQUAL, '€': C.KC_E,
+		},
+	),
+	"qwertz": newHostLayout(
+		"abcdefghijklmnopqrstuvwxzy1234567890ß ü+ #öä ,.-<",
+		"ABCDEFGHIJKLMNOPQRSTUVWXZY!\"§$%&/()=? Ü* 'ÖÄ°;:_>",
+		map[rune]uint8{
+			'@': C.KC_Q, '²': C.KC_2, '³': C.KC_3, '{': C.KC_7, '[': C.KC_8,
+			']': C.KC_9, '}': C.KC_0, '\\': C.KC_MINUS, '~': C.KC_RBRACKET,
+			'|': C.KC_NONUS_BSLASH, '€': C.KC_E, 'µ': C.KC_M,
+		},
+	),
+}
+
+// Find the key that types the same character on the host as code does on a US
+// host, with Shift if shift is set or Shift is held. Keys that do not type a
+// character, such as modifiers and arrows, and characters that the host layout
+// lacks are sent as they are.
+func (s *state) hostKey(code uint8, shift bool) hostKey {
+	k := hostKey{code: code, shift: shift || s.shifted()}
+	if r, ok := hostLayouts["us"].chars[k]; ok {
+		if h, ok := devices[s.device].layout.keys[r]; ok {
+			return h
+		}
+	}
+	return k
+}
+
+// Tap k on the host with the modifiers that it requires.
+func (s *state) typeHostKey(k hostKey) {
+	restore := s.hostModifiers(k)
+	s.handleKey(k.code)
+	restore()
+}
+
+func (s *state) shifted() bool {
+	return s.modifiers[getModifierIndex(C.KC_LSHIFT)] || s.modifiers[getModifierIndex(C.KC_RSHIFT)]
+}
+
+// Press and release Shift and press AltGr as k requires on the host, bypassing
+// the modifier state. Return the function that restores the modifiers that are
+// still set.
+func (s *state) hostModifiers(k hostKey) func() {
+	w := s.output()
+	var pressed, released []uint8
+	for _, code := range []uint8{C.KC_LSHIFT, C.KC_RSHIFT} {
+		if s.modifiers[getModifierIndex(code)] && !k.shift {
+			w.releaseDesktop(code)
+			released = append(released, code)
+		}
+	}
+	if k.shift && !s.shifted() {
+		w.pressDesktop(C.KC_LSHIFT)
+		pressed = append(pressed, C.KC_LSHIFT)
+	}
+	if k.altGr && !s.modifiers[getModifierIndex(C.KC_RALT)] {
+		w.pressDesktop(C.KC_RALT)
+		pressed = append(pressed, C.KC_RALT)
+	}
+	return func() {
+		for _, code := range pressed {
+			w.releaseDesktop(code)
+		}
+		for _, code := range released {
+			if s.modifiers[getModifierIndex(code)] {
+				w.pressDesktop(code)
+			}
+		}
+	}
+}
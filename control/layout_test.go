@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestRolloverReleasesHostModifiers(t *testing.T) {
+	tests := []struct {
+		name   string
+		host   string
+		caps   bool
+		keys   layer
+		events []testEvent
+		want   string
+	}{
+		{
+			name:   "shifted digit on azerty",
+			host:   "azerty",
+			keys:   layer{kc2, kcALower},
+			events: []testEvent{press(0, 0), press(10, 1), release(20, 0), release(30, 1)},
+			want:   "+KC_LSHIFT +KC_2 -KC_LSHIFT +KC_Q -KC_2 -KC_Q",
+		},
+		{
+			name:   "caps word letter into digit",
+			host:   "us",
+			caps:   true,
+			keys:   layer{kcALower, kc1},
+			events: []testEvent{press(0, 0), press(10, 1), release(20, 0), release(30, 1)},
+			want:   "+KC_LSHIFT +KC_A -KC_LSHIFT +KC_1 -KC_A -KC_1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, log := newTestState(tt.keys)
+			devices["test"] = config{writer: devices["test"].writer, layout: hostLayouts[tt.host]}
+			s.capsWord = tt.caps
+			if got := runEvents(s, log, tt.events); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+// #include "keycode.h"
+import "C"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Define the default time in milliseconds to type each key of a leader
+// sequence.
+const defaultLeaderTimeout = 1000
+
+// Define a sequence of desktop keys that runs key when typed after the leader
+// key. Keys are matched by their code regardless of the layout of the host.
+type leaderSequence struct {
+	codes []uint8
+	key   key
+}
+
+type leaderConfig struct {
+	timeout   int
+	sequences []leaderSequence
+}
+
+type leaderSpec struct {
+	Timeout   *int `json:"timeout"`
+	Sequences []struct {
+		Keys []string        `json:"keys"`
+		Key  json.RawMessage `json:"key"`
+	} `json:"sequences"`
+}
+
+// Define a leader sequence that is being typed.
+type pendingSequence struct {
+	codes    []uint8
+	deadline time.Time
+}
+
+func parseLeader(spec leaderSpec) (leaderConfig, error) {
+	var errs errorList
+	l := leaderConfig{timeout: defaultLeaderTimeout}
+	if spec.Timeout != nil {
+		l.timeout = *spec.Timeout
+		if l.timeout <= 0 {
+			errs = append(errs, errors.New("leader timeout must be positive"))
+		}
+	}
+	for i, value := range spec.Sequences {
+		var seq leaderSequence
+		err := func() error {
+			if len(value.Keys) == 0 {
+				return errors.New("sequence requires keys")
+			}
+			for _, name := range value.Keys {
+				code, err := parseKeycode(name)
+				if err != nil {
+					return err
+				}
+				seq.codes = append(seq.codes, code)
+			}
+			k, err := parseKey(value.Key)
+			if err != nil {
+				return err
+			}
+			if k == nil {
+				return errors.New("sequence requires key")
+			}
+			seq.key = k
+			return nil
+		}()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("leader sequence %d: %v", i, err))
+		}
+		l.sequences = append(l.sequences, seq)
+	}
+	if errs != nil {
+		return leaderConfig{}, errs
+	}
+	return l, nil
+}
+
+func (l leaderConfig) wait() time.Duration {
+	return time.Duration(l.timeout) * time.Millisecond
+}
+
+// Start a leader sequence. Keys typed until the sequence ends are not sent to
+// the device.
+func (k leaderKey) handle(s *state) {
+	s.sequence = &pendingSequence{deadline: s.at.Add(leader.wait())}
+	s.handleKey(0)
+}
+
+// Add k to the leader sequence being typed. Layer keys are handled as usual so
+// that sequences may use keys on other layers. Escape and the leader key cancel
+// the sequence, as does any key that cannot be part of a sequence. Return false
+// if k is not consumed.
+func (s *state) typeSequence(k key) bool {
+	d, ok := k.(desktopKey)
+	switch {
+	case isLayerKey(k):
+		return false
+	case !ok || d.code == C.KC_ESCAPE:
+		s.sequence = nil
+		return true
+	}
+
+	p := s.sequence
+	p.codes = append(p.codes, d.code)
+	p.deadline = s.at.Add(leader.wait())
+	match, longer := s.matchSequence()
+	switch {
+	case match != nil && !longer:
+		s.endSequence()
+	case match == nil && !longer:
+		s.sequence = nil
+	}
+	return true
+}
+
+func isLayerKey(k key) bool {
+	_, ok := k.(layerKey)
+	return ok
+}
+
+// Find the sequence that matches the keys typed so far and whether a longer
+// sequence starts with them.
+func (s *state) matchSequence() (match key, longer bool) {
+	codes := s.sequence.codes
+	for _, value := range leader.sequences {
+		if len(value.codes) < len(codes) {
+			continue
+		}
+		prefix := true
+		for key, code := range codes {
+			prefix = prefix && value.codes[key] == code
+		}
+		switch {
+		case !prefix:
+		case len(value.codes) == len(codes):
+			match = value.key
+		default:
+			longer = true
+		}
+	}
+	return match, longer
+}
+
+// End the leader sequence and handle the key of the matching sequence, if any.
+// Commands run right away since typing the sequence already guards against
+// running them by accident.
+func (s *state) endSequence() {
+	match, _ := s.matchSequence()
+	s.sequence = nil
+	if match == nil {
+		return
+	}
+	if k, ok := match.(commandKey); ok {
+		s.lock = k.lock
+	}
+	match.handle(s)
+}
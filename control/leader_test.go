@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestLeader(t *testing.T) {
+	mo := layerKey{layer: 1, mode: layerMomentary}
+	tests := []struct {
+		name   string
+		events []testEvent
+		want   string
+	}{
+		{
+			name:   "sequence",
+			events: []testEvent{press(0, 0), release(10, 0), press(20, 1), release(30, 1), press(40, 2), release(50, 2)},
+			want:   "+KC_TAB -KC_TAB",
+		},
+		{
+			name:   "unknown sequence",
+			events: []testEvent{press(0, 0), release(10, 0), press(20, 1), release(30, 1), press(40, 1), release(50, 1), press(60, 2), release(70, 2)},
+			want:   "+KC_B -KC_B",
+		},
+		{
+			name:   "escape",
+			events: []testEvent{press(0, 0), release(10, 0), press(20, 1), release(30, 1), press(40, 3), release(50, 3), press(60, 2), release(70, 2)},
+			want:   "+KC_B -KC_B",
+		},
+		{
+			name:   "key on another layer",
+			events: []testEvent{press(0, 0), release(10, 0), press(20, 1), release(30, 1), press(40, 4), press(50, 1), release(60, 1), release(70, 4)},
+			want:   "+KC_TAB -KC_TAB",
+		},
+		{
+			name:   "after sequence",
+			events: []testEvent{press(0, 0), release(10, 0), press(20, 1), press(30, 2), press(40, 2), release(50, 2)},
+			want:   "+KC_TAB -KC_TAB +KC_B -KC_B",
+		},
+		{
+			name:   "timeout",
+			events: []testEvent{press(0, 0), release(10, 0), press(20, 2), release(30, 2), press(40, 2), release(50, 2), tick(1040)},
+			want:   "+KC_DELETE -KC_DELETE",
+		},
+		{
+			name:   "timeout after last key",
+			events: []testEvent{press(0, 0), release(10, 0), press(20, 2), release(30, 2), press(40, 2), release(50, 2), tick(1030), press(1035, 2), release(1045, 2)},
+			want:   "+KC_ESCAPE -KC_ESCAPE",
+		},
+		{
+			name:   "key after timeout",
+			events: []testEvent{press(0, 0), release(10, 0), press(1000, 1), release(1010, 1)},
+			want:   "+KC_A -KC_A",
+		},
+	}
+	for _, tt := range tests {
+		s, log := newTestState(
+			layer{kcLeader, kcALower, kcBLower, kcEscape, mo},
+			layer{nil, kcBLower, nil, nil, nil},
+		)
+		leader.sequences = []leaderSequence{
+			{codes: []uint8{kcALower.code, kcBLower.code}, key: kcTab},
+			{codes: []uint8{kcBLower.code, kcBLower.code, kcBLower.code}, key: kcEscape},
+			{codes: []uint8{kcBLower.code, kcBLower.code}, key: kcDelete},
+		}
+		if got := runEvents(s, log, tt.events); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+// #include "keycode.h"
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Define the number of dynamic macro slots.
+const macroSlots = 8
+
+type macroOp int
+
+const (
+	macroRecord macroOp = iota
+	macroStop
+	macroPlay
+)
+
+var macroOps = map[string]macroOp{
+	"record": macroRecord,
+	"stop":   macroStop,
+	"play":   macroPlay,
+}
+
+// Define key type for recording and playing dynamic macros. Recording into a
+// slot replaces its macro. Pressing a record key while recording stops it. See
+// https://docs.qmk.fm/#/feature_dynamic_macros for the terminology.
+type macroKey struct {
+	op   macroOp
+	slot int
+}
+
+// Define an event sent to a writer. Exactly one field other than Shift is set.
+// Desktop keys are recorded as the keys of the keymap, with Shift set for keys
+// that are shifted, and characters typed by Unicode and compose keys as Char.
+// Both are typed on the layout of the device that the macro is played on. The
+// events are stored in the macro file as JSON, which holds one list of events
+// per slot.
+type macroEvent struct {
+	Press    *uint8   `json:"press,omitempty"`
+	Shift    bool     `json:"shift,omitempty"`
+	Release  *uint8   `json:"release,omitempty"`
+	Char     *rune    `json:"char,omitempty"`
+	Consumer *uint16  `json:"consumer,omitempty"`
+	Mouse    *[4]int8 `json:"mouse,omitempty"`
+}
+
+// Track the macro being recorded.
+type macroRecording struct {
+	slot   int
+	events []macroEvent
+}
+
+// Pass events through to the writer of the current device while recording
+// them.
+type macroRecorder struct {
+	writer
+	s *state
+}
+
+func (r macroRecorder) pressDesktop(key uint8) {
+	r.writer.pressDesktop(key)
+	r.s.record(macroEvent{Press: &key})
+}
+
+func (r macroRecorder) releaseDesktop(key uint8) {
+	r.writer.releaseDesktop(key)
+	r.s.record(macroEvent{Release: &key})
+}
+
+func (r macroRecorder) sendConsumer(key uint16) {
+	r.writer.sendConsumer(key)
+	r.s.record(macroEvent{Consumer: &key})
+}
+
+func (r macroRecorder) sendMouse(buttons uint8, x, y, wheel int8) {
+	r.writer.sendMouse(buttons, x, y, wheel)
+	r.s.record(macroEvent{Mouse: &[4]int8{int8(buttons), x, y, wheel}})
+}
+
+// Get the writer for the current device. Events are recorded if a macro is
+// being recorded.
+func (s *state) output() writer {
+	return macroRecorder{writer: devices[s.device].writer, s: s}
+}
+
+func (s *state) record(ev macroEvent) {
+	if s.recording != nil {
+		s.recording.events = append(s.recording.events, ev)
+	}
+}
+
+// Call f, which sends what depends on the layout or the input methods of the
+// device, and record events in its place. Modifiers that f releases, such as
+// unlocked modifiers used up by a key, are recorded as released after events.
+func (s *state) recordAs(f func(), events ...macroEvent) {
+	recording := s.recording
+	if recording == nil {
+		f()
+		return
+	}
+	recording.events = append(recording.events, events...)
+	modifiers := s.modifiers
+	s.recording = nil
+	f()
+	s.recording = recording
+	for key, value := range modifiers {
+		if value && !s.modifiers[key] {
+			code := C.KC_LCTRL + uint8(key)
+			s.record(macroEvent{Release: &code})
+		}
+	}
+}
+
+// Load the macros from the macro file. If the file does not exist, every slot
+// is empty.
+func loadMacros(path string) ([][]macroEvent, error) {
+	macros := make([][]macroEvent, macroSlots)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return macros, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &macros); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for len(macros) < macroSlots {
+		macros = append(macros, nil)
+	}
+	return macros, nil
+}
+
+// Write the macros to the macro file. The file is replaced rather than written
+// to so that it is never left partially written.
+func saveMacros(path string, macros [][]macroEvent) error {
+	data, err := json.Marshal(macros)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path))
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (k macroKey) handle(s *state) {
+	switch {
+	case s.recording != nil && k.op != macroPlay:
+		// Save the macro. Failing to save only loses it after a restart.
+		macros[s.recording.slot] = s.recording.events
+		s.recording = nil
+		if err := saveMacros(*macroPath, macros); err != nil {
+			log.Print(err)
+		}
+	case k.op == macroRecord:
+		s.recording = &macroRecording{slot: k.slot}
+	case k.op == macroPlay && s.recording == nil:
+		s.play(macros[k.slot])
+	}
+}
+
+// Replay events to the current device, which may differ from the device they
+// were recorded on. The events are played on a state of their own so that
+// modifiers pressed by the macro apply to its keys only as they did while it
+// was recorded. Keys, modifiers, and buttons left pressed by the macro are
+// released.
+func (s *state) play(events []macroEvent) {
+	p := &state{device: s.device}
+	w := p.output()
+	held := make(map[uint8]func())
+	var buttons uint8
+	for _, ev := range events {
+		switch {
+		case ev.Press != nil && isModifier(*ev.Press):
+			if i := getModifierIndex(*ev.Press); !p.modifiers[i] {
+				w.pressDesktop(*ev.Press)
+				p.modifiers[i], p.modLocks[i] = true, true
+			}
+		case ev.Press != nil:
+			if p.hostRestore != nil {
+				p.hostRestore()
+			}
+			held[*ev.Press] = desktopKey{code: *ev.Press, shift: ev.Shift}.press(p)
+		case ev.Release != nil && isModifier(*ev.Release):
+			if i := getModifierIndex(*ev.Release); p.modifiers[i] {
+				p.releaseModifier(int(i))
+			}
+		case ev.Release != nil:
+			if release := held[*ev.Release]; release != nil {
+				delete(held, *ev.Release)
+				release()
+			}
+		case ev.Char != nil:
+			composeKey(*ev.Char).handle(p)
+		case ev.Consumer != nil:
+			w.sendConsumer(*ev.Consumer)
+		case ev.Mouse != nil:
+			buttons = uint8(ev.Mouse[0])
+			w.sendMouse(buttons, ev.Mouse[1], ev.Mouse[2], ev.Mouse[3])
+		}
+	}
+	for _, release := range held {
+		release()
+	}
+	for key, value := range p.modifiers {
+		if value {
+			p.releaseModifier(key)
+		}
+	}
+	if buttons != 0 {
+		w.sendMouse(0, 0, 0, 0)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMacros(t *testing.T) {
+	*macroPath = filepath.Join(t.TempDir(), "macros.json")
+	record, play := macroKey{macroRecord, 0}, macroKey{macroPlay, 0}
+
+	s, log := newTestState(layer{record, play, kcALower, kcBLower})
+	macros = make([][]macroEvent, macroSlots)
+	got := runEvents(s, log, []testEvent{
+		press(0, 0), release(10, 0),
+		press(20, 2), release(30, 2),
+		press(40, 1), release(50, 1),
+		press(60, 3), release(70, 3),
+		press(80, 0), release(90, 0),
+		press(100, 1), release(110, 1),
+	})
+	if want := "+KC_A -KC_A +KC_B -KC_B +KC_A -KC_A +KC_B -KC_B"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	saved, err := loadMacros(*macroPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, macros) {
+		t.Errorf("saved %v, want %v", saved, macros)
+	}
+
+	// Keys that are still held when recording stops are released after the
+	// macro is played.
+	*log = nil
+	got = runEvents(s, log, []testEvent{
+		press(200, 0), release(210, 0),
+		press(220, 2),
+		press(230, 0), release(240, 0),
+		release(250, 2),
+		press(260, 1), release(270, 1),
+	})
+	if want := "+KC_A -KC_A +KC_A -KC_A"; got != want {
+		t.Errorf("held key: got %q, want %q", got, want)
+	}
+}
+
+// Test that a macro types the same characters on a device whose host layout
+// differs from the one it was recorded on.
+func TestMacroLayout(t *testing.T) {
+	*macroPath = filepath.Join(t.TempDir(), "macros.json")
+	s, log := newTestState(layer{macroKey{macroRecord, 1}, macroKey{macroPlay, 1}, kc1, composeKey('é')})
+	macros = make([][]macroEvent, macroSlots)
+	runEvents(s, log, []testEvent{
+		press(0, 0), release(10, 0),
+		press(20, 2), release(30, 2),
+		press(40, 3), release(50, 3),
+		press(60, 0), release(70, 0),
+	})
+	devices["test"] = config{writer: testWriter{log}, layout: hostLayouts["azerty"]}
+	*log = nil
+	got := runEvents(s, log, []testEvent{press(100, 1), release(110, 1)})
+	if want := "+KC_LSHIFT +KC_1 -KC_1 -KC_LSHIFT +KC_2 -KC_2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -3,42 +3,103 @@
 
 package main
 
-import "log"
-
-// Define MAC addresses of the two keyboard halves. Note that these are in the
-// reverse order of the printable address.
-const (
-	leftMAC  = "000000000000"
-	rightMAC = "111111111111"
+import (
+	"flag"
+	"log"
+	"os"
 )
 
-const defaultDevice = "abc123"
+// Define the built-in device configuration, which is used when there is no
+// configuration file. The MAC addresses of the two keyboard halves are in the
+// reverse order of the printable address. Gadget and uinput devices do not have
+// a MAC address. The temporary Bluetooth device has an empty MAC address.
+var defaultConfig = configFile{
+	Left:     "000000000000",
+	Right:    "111111111111",
+	Default:  "abc123",
+	Geometry: &defaultGeometry,
+	Devices: map[string]deviceSpec{
+		"abc123": {Transport: "gadget", Platform: "linux"},
+		"def123": {Transport: "bluez", MAC: "00:00:00:00:00:00", Platform: "macos", Host: "colemak"},
+		"ghi123": {Transport: "bluez", MAC: "00:00:00:00:00:01", Platform: "macos"},
+
+		// Android has no Unicode method, so the emoji keys do nothing there.
+		"jkl123": {Transport: "bluez", MAC: "00:00:00:00:00:02", Platform: "android", Unicode: "none"},
+		"mno123": {Transport: "bluez", MAC: "00:00:00:00:00:03", Platform: "windows", Host: "colemak"},
+		"tmp123": {Transport: "bluez", Platform: "macos"},
+
+		// Define writer for outputting to the controller itself. This device
+		// is called uin123 since it goes through /dev/uinput and the physical
+		// device may vary.
+		"uin123": {Transport: "uinput", Platform: "linux"},
+	},
+}
+
+// Track the layers, devices, and keyboard halves from the configuration along
+// with the dynamic macros. These are only modified by the goroutine handling
+// events once input is handled.
+var (
+	layers        []layer
+	deviceLayers  map[string][]layer
+	tapping       tappingConfig
+	combos        [][]combo
+	comboTerm     int
+	leader        leaderConfig
+	overrides     [][]keyOverride
+	autoShift     autoShiftConfig
+	macros        [][]macroEvent
+	board         geometry
+	devices       map[string]config
+	leftMAC       string
+	rightMAC      string
+	defaultDevice string
+)
 
-// Initialize Bluetooth devices. Gadget and uinput are initialized in main().
-// Define the temporary Bluetooth device with an empty MAC address.
-var devices = map[string]config{
-	"def123": {writer: newBlueZWriter("00:00:00:00:00:00"), platform: platMacOS, qwerty: true},
-	"ghi123": {writer: newBlueZWriter("00:00:00:00:00:00"), platform: platMacOS},
-	"jkl123": {writer: newBlueZWriter("00:00:00:00:00:00"), platform: platAndroid},
-	"mno123": {writer: newBlueZWriter("00:00:00:00:00:00"), platform: platWindows, qwerty: true},
-	"tmp123": {writer: newBlueZWriter(""), platform: platMacOS},
+// Make the keymap current.
+func useKeymap(km *keymap) {
+	layers, deviceLayers, tapping = km.layers, km.devices, km.tapping
+	combos, comboTerm, leader = km.combos, km.comboTerm, km.leader
+	overrides, autoShift = km.overrides, km.autoShift
 }
 
+// Read the keymap, the device configuration, and the dynamic macros from
+// src/control by default, consistent with the other files under src/control.
+// The compiled layers and defaultConfig are used if the files are absent.
+var (
+	keymapPath = flag.String("keymap", "src/control/keymap.json", "keymap file")
+	configPath = flag.String("config", "src/control/config.json", "device configuration file")
+	macroPath  = flag.String("macros", "src/control/macros.json", "dynamic macro file")
+)
+
 func main() {
-	if w, err := newGadgetWriter(); err != nil {
+	// Run "control check" to validate the keymap and device configuration
+	// before deploying them. Run "control render" to draw the keymap and
+	// "control import-qmk" to convert a QMK keymap.
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "check":
+		os.Exit(runCheck())
+	case "render":
+		os.Exit(runRender(flag.Args()[1:]))
+	case "import-qmk":
+		os.Exit(runImportQMK(flag.Args()[1:]))
+	}
+
+	km, c, err := loadSettings()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if macros, err = loadMacros(*macroPath); err != nil {
 		log.Fatal(err)
-	} else {
-		devices["abc123"] = config{writer: w, platform: platLinux}
 	}
 
-	// Define writer for outputting to the controller itself. This device is
-	// called uin123 since it goes through /dev/uinput and the physical device
-	// may vary.
-	if w, err := newUinputWriter(); err != nil {
+	// Initialize writers for every device.
+	if devices, err = newDevices(c); err != nil {
 		log.Fatal(err)
-	} else {
-		devices["uin123"] = config{writer: w, platform: platLinux}
 	}
+	useKeymap(km)
+	board = *c.Geometry
+	leftMAC, rightMAC, defaultDevice = c.Left, c.Right, c.Default
 
 	// Setup Bluetooth listener. This will return once everything is setup.
 	if err := handleBlueZ(); err != nil {
@@ -0,0 +1,114 @@
+package main
+
+import "time"
+
+// Define how mouse keys move the pointer, following QMK mouse keys. Movement
+// starts at 1 unit per interval and accelerates to mouseMaxSpeed units over
+// mouseTimeToMax. The wheel scrolls 1 unit every mouseWheelTicks intervals.
+const (
+	mouseInterval   = 20 * time.Millisecond
+	mouseMaxSpeed   = 20
+	mouseTimeToMax  = time.Second
+	mouseWheelTicks = 5
+)
+
+// Define key type for the mouse. Buttons is a bit field of buttons to click,
+// with bit 0 for the left button, bit 1 for the right button, and bit 2 for the
+// middle button. X, y, and wheel give the direction to move or scroll in.
+type mouseKey struct {
+	buttons     uint8
+	x, y, wheel int
+}
+
+// Track mouse buttons and movement. X, y, and wheel are the sums of the
+// directions of the held mouse keys.
+type mouseState struct {
+	buttons     uint8
+	x, y, wheel int
+	since, next time.Time
+	ticks       int
+}
+
+func isMouseKey(k key) bool {
+	_, ok := k.(mouseKey)
+	return ok
+}
+
+// Limit a movement to the range of the mouse report.
+func clampMouse(value int) int8 {
+	switch {
+	case value > 127:
+		return 127
+	case value < -127:
+		return -127
+	}
+	return int8(value)
+}
+
+func (s *state) sendMouse(x, y, wheel int) {
+	s.output().sendMouse(s.mouse.buttons, clampMouse(x), clampMouse(y), clampMouse(wheel))
+}
+
+// Click the buttons or move by a single unit.
+func (k mouseKey) handle(s *state) {
+	if k.buttons != 0 {
+		s.mouse.buttons |= k.buttons
+		s.sendMouse(0, 0, 0)
+		s.mouse.buttons &^= k.buttons
+	}
+	s.sendMouse(k.x, k.y, k.wheel)
+}
+
+// Hold the buttons or keep moving until the key is released.
+func (k mouseKey) press(s *state) func() {
+	if k.buttons != 0 {
+		s.mouse.buttons |= k.buttons
+		s.sendMouse(0, 0, 0)
+		return func() {
+			s.mouse.buttons &^= k.buttons
+			s.sendMouse(0, 0, 0)
+		}
+	}
+
+	// Move right away if the pointer is not moving already. Otherwise, the
+	// key takes effect on the next interval.
+	m := &s.mouse
+	idle := m.x == 0 && m.y == 0 && m.wheel == 0
+	m.x, m.y, m.wheel = m.x+k.x, m.y+k.y, m.wheel+k.wheel
+	if idle {
+		now := time.Now()
+		m.since, m.next, m.ticks = now, now, 0
+		s.moveMouse(now)
+	}
+	return func() {
+		m.x, m.y, m.wheel = m.x-k.x, m.y-k.y, m.wheel-k.wheel
+	}
+}
+
+// Move the pointer and scroll for held mouse keys if an interval has passed.
+func (s *state) moveMouse(now time.Time) {
+	m := &s.mouse
+	if m.x == 0 && m.y == 0 && m.wheel == 0 || now.Before(m.next) {
+		return
+	}
+	speed := 1 + int(time.Duration(mouseMaxSpeed-1)*now.Sub(m.since)/mouseTimeToMax)
+	if speed > mouseMaxSpeed {
+		speed = mouseMaxSpeed
+	}
+	var wheel int
+	if m.ticks%mouseWheelTicks == 0 {
+		wheel = m.wheel
+	}
+	s.sendMouse(m.x*speed, m.y*speed, wheel)
+	m.next, m.ticks = now.Add(mouseInterval), m.ticks+1
+}
+
+// Get a channel that receives when the pointer must move next, or nil if no
+// mouse key is moving it.
+func (s *state) mouseTimer() <-chan time.Time {
+	m := &s.mouse
+	if m.x == 0 && m.y == 0 && m.wheel == 0 {
+		return nil
+	}
+	return time.After(time.Until(m.next))
+}
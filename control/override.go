@@ -0,0 +1,169 @@
+package main
+
+// #include "keycode.h"
+import "C"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Define a rule that presses key instead of the desktop key trigger while
+// every modifier in mods is active, such as Delete for Shift + Backspace. The
+// modifiers are consumed rather than sent with key. A rule with no platforms
+// applies on every platform.
+type keyOverride struct {
+	mods      []string
+	trigger   uint8
+	key       key
+	platforms []platform
+}
+
+type overrideSpec struct {
+	Mods      []string        `json:"mods"`
+	Trigger   string          `json:"trigger"`
+	Key       json.RawMessage `json:"key"`
+	Platforms []string        `json:"platforms"`
+}
+
+// Map the modifiers of a rule to their left keys. Either side satisfies the
+// rule.
+var overrideMods = map[string]uint8{
+	"ctrl":  C.KC_LCTRL,
+	"shift": C.KC_LSHIFT,
+	"alt":   C.KC_LALT,
+	"gui":   C.KC_LGUI,
+}
+
+func parseOverride(spec overrideSpec) (keyOverride, error) {
+	if len(spec.Mods) == 0 {
+		return keyOverride{}, errors.New("override requires mods")
+	}
+	for _, value := range spec.Mods {
+		if _, ok := overrideMods[value]; !ok {
+			return keyOverride{}, fmt.Errorf("unknown modifier %q", value)
+		}
+	}
+	code, err := parseKeycode(spec.Trigger)
+	if err != nil {
+		return keyOverride{}, err
+	}
+	if isModifier(code) {
+		return keyOverride{}, errors.New("override trigger cannot be a modifier")
+	}
+	k, err := parseKey(spec.Key)
+	if err != nil {
+		return keyOverride{}, err
+	}
+	if k == nil {
+		return keyOverride{}, errors.New("override requires key")
+	}
+	o := keyOverride{mods: spec.Mods, trigger: code, key: k}
+	for _, value := range spec.Platforms {
+		p, ok := platforms[value]
+		if !ok {
+			return keyOverride{}, fmt.Errorf("unknown platform %q", value)
+		}
+		o.platforms = append(o.platforms, p)
+	}
+	return o, nil
+}
+
+// Get the indices of the active modifiers that satisfy the rule, or nil if the
+// rule does not apply.
+func (o keyOverride) match(s *state, code uint8) []int {
+	if code != o.trigger {
+		return nil
+	}
+	if len(o.platforms) > 0 {
+		ok := false
+		for _, value := range o.platforms {
+			ok = ok || value == devices[s.device].platform
+		}
+		if !ok {
+			return nil
+		}
+	}
+	var result []int
+	for _, name := range o.mods {
+		i := int(getModifierIndex(overrideMods[name]))
+		found := false
+		for _, j := range []int{i, i + 4} {
+			if s.modifiers[j] {
+				result = append(result, j)
+				found = true
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	return result
+}
+
+// Define a key that replaces the trigger of a rule, along with the modifiers
+// that the rule consumes.
+type overriddenKey struct {
+	key  key
+	mods []int
+}
+
+// Get the key to press in place of k. The first rule on the highest active
+// layer that matches k applies.
+func (s *state) applyOverride(k key) key {
+	d, ok := k.(desktopKey)
+	i := s.layer.top()
+	if !ok || i >= len(overrides) {
+		return k
+	}
+	for _, o := range overrides[i] {
+		if mods := o.match(s, d.code); mods != nil {
+			return overriddenKey{key: o.key, mods: mods}
+		}
+	}
+	return k
+}
+
+// Release the consumed modifiers so that they are not sent with the key.
+// Unlocked modifiers are used up like they are by any other key. Return the
+// function that presses locked modifiers again.
+func (s *state) consumeModifiers(mods []int) func() {
+	var locked []int
+	for _, i := range mods {
+		if !s.modifiers[i] {
+			continue
+		}
+		if s.modLocks[i] {
+			locked = append(locked, i)
+		}
+		s.releaseModifier(i)
+	}
+	return func() {
+		for _, i := range locked {
+			if !s.modifiers[i] {
+				s.output().pressDesktop(C.KC_LCTRL + uint8(i))
+				s.modifiers[i], s.modLocks[i] = true, true
+			}
+		}
+	}
+}
+
+func (k overriddenKey) handle(s *state) {
+	restore := s.consumeModifiers(k.mods)
+	k.key.handle(s)
+	restore()
+}
+
+func (k overriddenKey) press(s *state) func() {
+	restore := s.consumeModifiers(k.mods)
+	release := s.pressKey(k.key)
+	if release == nil {
+		restore()
+		return nil
+	}
+	return func() {
+		release()
+		restore()
+	}
+}
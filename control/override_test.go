@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestKeyOverride(t *testing.T) {
+	tests := []struct {
+		name      string
+		platforms []platform
+		events    []testEvent
+		want      string
+	}{
+		{
+			name:   "held modifier",
+			events: []testEvent{press(0, 0), press(10, 1), release(20, 1), release(30, 0)},
+			want:   "+KC_LSHIFT -KC_LSHIFT +KC_DELETE -KC_DELETE +KC_LSHIFT -KC_LSHIFT",
+		},
+		{
+			name:   "tapped modifier",
+			events: []testEvent{press(0, 0), release(10, 0), press(20, 1), release(30, 1)},
+			want:   "+KC_LSHIFT -KC_LSHIFT +KC_DELETE -KC_DELETE",
+		},
+		{
+			name:   "no modifier",
+			events: []testEvent{press(0, 1), release(10, 1)},
+			want:   "+KC_BSPACE -KC_BSPACE",
+		},
+		{
+			name:   "other modifier",
+			events: []testEvent{press(0, 2), press(10, 1), release(20, 1), release(30, 2)},
+			want:   "+KC_LCTRL +KC_BSPACE -KC_BSPACE -KC_LCTRL",
+		},
+		{
+			name:      "other platform",
+			platforms: []platform{platMacOS},
+			events:    []testEvent{press(0, 0), press(10, 1), release(20, 1), release(30, 0)},
+			want:      "+KC_LSHIFT +KC_BSPACE -KC_BSPACE -KC_LSHIFT",
+		},
+	}
+	for _, tt := range tests {
+		s, log := newTestState(layer{kcLShift, kcBspace, kcLCtrl})
+		overrides = [][]keyOverride{{{mods: []string{"shift"}, trigger: kcBspace.code, key: kcDelete, platforms: tt.platforms}}}
+		if got := runEvents(s, log, tt.events); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Define the subset of a QMK keymap.json that is imported. See
+// https://docs.qmk.fm/#/reference_configurator_support for the format.
+type qmkKeymap struct {
+	Layers [][]string `json:"layers"`
+}
+
+// Map QMK keycode names to the keycode.h names used by keycodes. Names that
+// are the same in both are not listed.
+var qmkAliases = map[string]string{
+	"KC_ENT":           "KC_ENTER",
+	"KC_ESC":           "KC_ESCAPE",
+	"KC_BSPC":          "KC_BSPACE",
+	"KC_BACKSPACE":     "KC_BSPACE",
+	"KC_SPC":           "KC_SPACE",
+	"KC_MINS":          "KC_MINUS",
+	"KC_EQL":           "KC_EQUAL",
+	"KC_LBRC":          "KC_LBRACKET",
+	"KC_LEFT_BRACKET":  "KC_LBRACKET",
+	"KC_RBRC":          "KC_RBRACKET",
+	"KC_RIGHT_BRACKET": "KC_RBRACKET",
+	"KC_BSLS":          "KC_BSLASH",
+	"KC_BACKSLASH":     "KC_BSLASH",
+	"KC_NUHS":          "KC_NONUS_HASH",
+	"KC_SCLN":          "KC_SCOLON",
+	"KC_SEMICOLON":     "KC_SCOLON",
+	"KC_QUOT":          "KC_QUOTE",
+	"KC_GRV":           "KC_GRAVE",
+	"KC_COMM":          "KC_COMMA",
+	"KC_SLSH":          "KC_SLASH",
+	"KC_CAPS":          "KC_CAPSLOCK",
+	"KC_CLCK":          "KC_CAPSLOCK",
+	"KC_CAPS_LOCK":     "KC_CAPSLOCK",
+	"KC_PSCR":          "KC_PSCREEN",
+	"KC_PRINT_SCREEN":  "KC_PSCREEN",
+	"KC_SCRL":          "KC_SCROLLLOCK",
+	"KC_SLCK":          "KC_SCROLLLOCK",
+	"KC_SCROLL_LOCK":   "KC_SCROLLLOCK",
+	"KC_PAUS":          "KC_PAUSE",
+	"KC_BRK":           "KC_PAUSE",
+	"KC_INS":           "KC_INSERT",
+	"KC_PGDN":          "KC_PGDOWN",
+	"KC_PAGE_DOWN":     "KC_PGDOWN",
+	"KC_PAGE_UP":       "KC_PGUP",
+	"KC_DEL":           "KC_DELETE",
+	"KC_RGHT":          "KC_RIGHT",
+	"KC_NUM":           "KC_NUMLOCK",
+	"KC_NLCK":          "KC_NUMLOCK",
+	"KC_NUM_LOCK":      "KC_NUMLOCK",
+	"KC_PSLS":          "KC_KP_SLASH",
+	"KC_PAST":          "KC_KP_ASTERISK",
+	"KC_PMNS":          "KC_KP_MINUS",
+	"KC_PPLS":          "KC_KP_PLUS",
+	"KC_PENT":          "KC_KP_ENTER",
+	"KC_P1":            "KC_KP_1",
+	"KC_P2":            "KC_KP_2",
+	"KC_P3":            "KC_KP_3",
+	"KC_P4":            "KC_KP_4",
+	"KC_P5":            "KC_KP_5",
+	"KC_P6":            "KC_KP_6",
+	"KC_P7":            "KC_KP_7",
+	"KC_P8":            "KC_KP_8",
+	"KC_P9":            "KC_KP_9",
+	"KC_P0":            "KC_KP_0",
+	"KC_PDOT":          "KC_KP_DOT",
+	"KC_PEQL":          "KC_KP_EQUAL",
+	"KC_NUBS":          "KC_NONUS_BSLASH",
+	"KC_APP":           "KC_APPLICATION",
+	"KC_LCTL":          "KC_LCTRL",
+	"KC_LEFT_CTRL":     "KC_LCTRL",
+	"KC_LSFT":          "KC_LSHIFT",
+	"KC_LEFT_SHIFT":    "KC_LSHIFT",
+	"KC_LEFT_ALT":      "KC_LALT",
+	"KC_LOPT":          "KC_LALT",
+	"KC_LEFT_GUI":      "KC_LGUI",
+	"KC_LCMD":          "KC_LGUI",
+	"KC_LWIN":          "KC_LGUI",
+	"KC_RCTL":          "KC_RCTRL",
+	"KC_RIGHT_CTRL":    "KC_RCTRL",
+	"KC_RSFT":          "KC_RSHIFT",
+	"KC_RIGHT_SHIFT":   "KC_RSHIFT",
+	"KC_RIGHT_ALT":     "KC_RALT",
+	"KC_ROPT":          "KC_RALT",
+	"KC_ALGR":          "KC_RALT",
+	"KC_RIGHT_GUI":     "KC_RGUI",
+	"KC_RCMD":          "KC_RGUI",
+	"KC_RWIN":          "KC_RGUI",
+}
+
+// Map QMK names of shifted characters to the keycode.h name of the unshifted
+// key.
+var qmkShifted = map[string]string{
+	"KC_TILD":  "KC_GRAVE",
+	"KC_TILDE": "KC_GRAVE",
+	"KC_EXLM":  "KC_1",
+	"KC_AT":    "KC_2",
+	"KC_HASH":  "KC_3",
+	"KC_DLR":   "KC_4",
+	"KC_PERC":  "KC_5",
+	"KC_CIRC":  "KC_6",
+	"KC_AMPR":  "KC_7",
+	"KC_ASTR":  "KC_8",
+	"KC_LPRN":  "KC_9",
+	"KC_RPRN":  "KC_0",
+	"KC_UNDS":  "KC_MINUS",
+	"KC_PLUS":  "KC_EQUAL",
+	"KC_LCBR":  "KC_LBRACKET",
+	"KC_RCBR":  "KC_RBRACKET",
+	"KC_PIPE":  "KC_BSLASH",
+	"KC_COLN":  "KC_SCOLON",
+	"KC_DQUO":  "KC_QUOTE",
+	"KC_DQT":   "KC_QUOTE",
+	"KC_LABK":  "KC_COMMA",
+	"KC_LT":    "KC_COMMA",
+	"KC_RABK":  "KC_DOT",
+	"KC_GT":    "KC_DOT",
+	"KC_QUES":  "KC_SLASH",
+}
+
+// Map QMK media keys to consumer page usages.
+var qmkConsumer = map[string]uint16{
+	"KC_MUTE":             0xe2,
+	"KC_AUDIO_MUTE":       0xe2,
+	"KC_VOLU":             0xe9,
+	"KC_AUDIO_VOL_UP":     0xe9,
+	"KC_VOLD":             0xea,
+	"KC_AUDIO_VOL_DOWN":   0xea,
+	"KC_MNXT":             0xb5,
+	"KC_MEDIA_NEXT_TRACK": 0xb5,
+	"KC_MPRV":             0xb6,
+	"KC_MEDIA_PREV_TRACK": 0xb6,
+	"KC_MSTP":             0xb7,
+	"KC_MEDIA_STOP":       0xb7,
+	"KC_MPLY":             0xcd,
+	"KC_MEDIA_PLAY_PAUSE": 0xcd,
+}
+
+// Map QMK modifier wrappers such as LSFT(kc) to the modifiers they apply.
+var qmkModifiers = map[string][]string{
+	"LCTL": {"KC_LCTRL"},
+	"C":    {"KC_LCTRL"},
+	"LSFT": {"KC_LSHIFT"},
+	"S":    {"KC_LSHIFT"},
+	"LALT": {"KC_LALT"},
+	"A":    {"KC_LALT"},
+	"LOPT": {"KC_LALT"},
+	"LGUI": {"KC_LGUI"},
+	"G":    {"KC_LGUI"},
+	"LCMD": {"KC_LGUI"},
+	"LWIN": {"KC_LGUI"},
+	"RCTL": {"KC_RCTRL"},
+	"RSFT": {"KC_RSHIFT"},
+	"RALT": {"KC_RALT"},
+	"ROPT": {"KC_RALT"},
+	"ALGR": {"KC_RALT"},
+	"RGUI": {"KC_RGUI"},
+	"RCMD": {"KC_RGUI"},
+	"RWIN": {"KC_RGUI"},
+	"LCS":  {"KC_LCTRL", "KC_LSHIFT"},
+	"LCA":  {"KC_LCTRL", "KC_LALT"},
+	"LSA":  {"KC_LSHIFT", "KC_LALT"},
+	"LAG":  {"KC_LALT", "KC_LGUI"},
+	"SGUI": {"KC_LSHIFT", "KC_LGUI"},
+	"LCAG": {"KC_LCTRL", "KC_LALT", "KC_LGUI"},
+	"MEH":  {"KC_LCTRL", "KC_LSHIFT", "KC_LALT"},
+	"HYPR": {"KC_LCTRL", "KC_LSHIFT", "KC_LALT", "KC_LGUI"},
+}
+
+// Map the names of mod-taps that have no modifier wrapper of the same name, as
+// in SFT_T(kc), to their modifiers. Other mod-taps such as LCTL_T(kc) use the
+// modifiers of their wrapper.
+var qmkModTaps = map[string][]string{
+	"CTL":  {"KC_LCTRL"},
+	"SFT":  {"KC_LSHIFT"},
+	"ALT":  {"KC_LALT"},
+	"OPT":  {"KC_LALT"},
+	"GUI":  {"KC_LGUI"},
+	"CMD":  {"KC_LGUI"},
+	"WIN":  {"KC_LGUI"},
+	"C_S":  {"KC_LCTRL", "KC_LSHIFT"},
+	"RCS":  {"KC_RCTRL", "KC_RSHIFT"},
+	"RSA":  {"KC_RSHIFT", "KC_RALT"},
+	"RAG":  {"KC_RALT", "KC_RGUI"},
+	"LSG":  {"KC_LSHIFT", "KC_LGUI"},
+	"SCMD": {"KC_LSHIFT", "KC_LGUI"},
+	"SWIN": {"KC_LSHIFT", "KC_LGUI"},
+	"ALL":  {"KC_LCTRL", "KC_LSHIFT", "KC_LALT", "KC_LGUI"},
+}
+
+// Map the modifier bits of MT(mod, kc) to their modifiers.
+var qmkModBits = map[string][]string{
+	"MOD_LCTL": {"KC_LCTRL"},
+	"MOD_LSFT": {"KC_LSHIFT"},
+	"MOD_LALT": {"KC_LALT"},
+	"MOD_LGUI": {"KC_LGUI"},
+	"MOD_RCTL": {"KC_RCTRL"},
+	"MOD_RSFT": {"KC_RSHIFT"},
+	"MOD_RALT": {"KC_RALT"},
+	"MOD_RGUI": {"KC_RGUI"},
+	"MOD_MEH":  {"KC_LCTRL", "KC_LSHIFT", "KC_LALT"},
+	"MOD_HYPR": {"KC_LCTRL", "KC_LSHIFT", "KC_LALT", "KC_LGUI"},
+}
+
+// Map QMK layer keys to the modes of layer keys.
+var qmkLayerModes = map[string]string{
+	"TO":  "to",
+	"DF":  "default",
+	"MO":  "momentary",
+	"TG":  "toggle",
+	"OSL": "osl",
+}
+
+// Split a QMK keycode expression such as LT(1, KC_SPC) into its function name
+// and arguments. A plain keycode has no arguments.
+func splitQMK(expr string) (string, []string, error) {
+	expr = strings.TrimSpace(expr)
+	open := strings.IndexByte(expr, '(')
+	if open < 0 {
+		return expr, nil, nil
+	}
+	if !strings.HasSuffix(expr, ")") {
+		return "", nil, fmt.Errorf("malformed keycode %q", expr)
+	}
+
+	// Split arguments on commas that are not nested in parentheses.
+	var args []string
+	depth, start := 0, open+1
+	for i := start; i < len(expr)-1; i++ {
+		switch expr[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(expr[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	args = append(args, strings.TrimSpace(expr[start:len(expr)-1]))
+	return strings.TrimSpace(expr[:open]), args, nil
+}
+
+// Define an importer that records constructs that could not be imported
+// exactly.
+type qmkImporter struct {
+	layers int
+	notes  []string
+}
+
+func (imp *qmkImporter) note(i, j int, format string, args ...interface{}) {
+	imp.notes = append(imp.notes, fmt.Sprintf("layer %d, position %d: ", i, j)+fmt.Sprintf(format, args...))
+}
+
+// QMK keycodes are keys on a US host, which matches the code of a desktopKey.
+func desktopSpec(name string) map[string]interface{} {
+	return map[string]interface{}{"desktop": name}
+}
+
+func (imp *qmkImporter) parseLayerArg(i, j int, arg string) (int, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 || n >= imp.layers {
+		imp.note(i, j, "layer %q does not exist", arg)
+		return 0, false
+	}
+	return n, true
+}
+
+// Convert a QMK keycode expression to a key in the keymap file format. Return
+// nil for transparent keys. Keys that cannot be imported do nothing.
+func (imp *qmkImporter) convert(i, j int, expr string) interface{} {
+	name, args, err := splitQMK(expr)
+	if err != nil {
+		imp.note(i, j, "%v", err)
+		return "kcNone"
+	}
+
+	if args == nil {
+		switch name {
+		case "KC_NO", "XXXXXXX", "":
+			return "kcNone"
+		case "KC_TRNS", "KC_TRANSPARENT", "_______":
+			return nil
+		}
+		if alias, ok := qmkAliases[name]; ok {
+			name = alias
+		}
+		if _, ok := keycodes[name]; ok {
+			return desktopSpec(name)
+		}
+		if base, ok := qmkShifted[name]; ok {
+			return map[string]interface{}{
+				"virtual": []interface{}{desktopSpec("KC_LSHIFT"), desktopSpec(base)},
+			}
+		}
+		if usage, ok := qmkConsumer[name]; ok {
+			return map[string]interface{}{"consumer": usage}
+		}
+		imp.note(i, j, "%s is not supported", name)
+		return "kcNone"
+	}
+
+	switch name {
+	case "TO", "DF", "MO", "TG", "OSL":
+		if len(args) != 1 {
+			break
+		}
+		n, ok := imp.parseLayerArg(i, j, args[0])
+		if !ok {
+			return "kcNone"
+		}
+		return map[string]interface{}{"layer": n, "mode": qmkLayerModes[name]}
+	}
+
+	if name == "LT" && len(args) == 2 {
+		n, ok := imp.parseLayerArg(i, j, args[0])
+		if !ok {
+			return "kcNone"
+		}
+		return map[string]interface{}{
+			"tap":  imp.convertNested(i, j, args[1]),
+			"hold": map[string]interface{}{"layer": n, "mode": "momentary"},
+		}
+	}
+
+	// Mod-taps such as LCTL_T(kc) and SFT_T(kc) hold the modifiers of the
+	// matching wrapper. MT(mod, kc) holds the modifiers of its bits.
+	if prefix := strings.TrimSuffix(name, "_T"); prefix != name && len(args) == 1 {
+		mods, ok := qmkModifiers[prefix]
+		if !ok {
+			mods, ok = qmkModTaps[prefix]
+		}
+		if ok {
+			return imp.modTap(i, j, mods, args[0])
+		}
+	}
+	if name == "MT" && len(args) == 2 {
+		var mods []string
+		for _, value := range strings.Split(args[0], "|") {
+			bits, ok := qmkModBits[strings.TrimSpace(value)]
+			if !ok {
+				imp.note(i, j, "modifier %q is not supported", strings.TrimSpace(value))
+				return "kcNone"
+			}
+			for _, mod := range bits {
+				if !containsString(mods, mod) {
+					mods = append(mods, mod)
+				}
+			}
+		}
+		return imp.modTap(i, j, mods, args[1])
+	}
+
+	if mods, ok := qmkModifiers[name]; ok && len(args) == 1 {
+		var v []interface{}
+		for _, value := range mods {
+			v = append(v, desktopSpec(value))
+		}
+		return map[string]interface{}{"virtual": append(v, imp.convertNested(i, j, args[0]))}
+	}
+
+	imp.note(i, j, "%s is not supported", expr)
+	return "kcNone"
+}
+
+// Convert a mod-tap that types tap when tapped and holds mods when held.
+func (imp *qmkImporter) modTap(i, j int, mods []string, tap string) interface{} {
+	var hold interface{} = desktopSpec(mods[0])
+	if len(mods) > 1 {
+		var v []interface{}
+		for _, value := range mods {
+			v = append(v, desktopSpec(value))
+		}
+		hold = map[string]interface{}{"virtual": v}
+	}
+	return map[string]interface{}{"tap": imp.convertNested(i, j, tap), "hold": hold}
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert a keycode expression within another. Keys within another key cannot
+// be transparent.
+func (imp *qmkImporter) convertNested(i, j int, expr string) interface{} {
+	if k := imp.convert(i, j, expr); k != nil {
+		return k
+	}
+	return "kcNone"
+}
+
+// Convert a QMK keymap.json to the keymap file format. Layers are padded or
+// truncated to the number of positions in the geometry. Every construct that
+// could not be imported exactly is listed in the returned notes.
+func importQMK(data []byte, g geometry) ([]byte, []string, error) {
+	var km qmkKeymap
+	if err := json.Unmarshal(data, &km); err != nil {
+		return nil, nil, err
+	}
+	if len(km.Layers) == 0 {
+		return nil, nil, fmt.Errorf("keymap has no layers")
+	}
+
+	imp := &qmkImporter{layers: len(km.Layers)}
+	out := make([][]interface{}, len(km.Layers))
+	for i, value := range km.Layers {
+		if len(value) != g.size() {
+			imp.notes = append(imp.notes, fmt.Sprintf("layer %d: %d positions, expected %d", i, len(value), g.size()))
+		}
+		out[i] = make([]interface{}, g.size())
+		for j, expr := range value {
+			if j < len(out[i]) {
+				out[i][j] = imp.convert(i, j, expr)
+			}
+		}
+	}
+
+	// Write one key per line so that the result is easy to edit.
+	var buf bytes.Buffer
+	buf.WriteString("{\"layers\": [\n")
+	for i, value := range out {
+		buf.WriteString("\t[\n")
+		for j, k := range value {
+			data, err := json.Marshal(k)
+			if err != nil {
+				return nil, nil, err
+			}
+			buf.WriteString("\t\t")
+			buf.Write(data)
+			if j < len(value)-1 {
+				buf.WriteByte(',')
+			}
+			buf.WriteByte('\n')
+		}
+		buf.WriteString("\t]")
+		if i < len(out)-1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("]}")
+	result := buf.Bytes()
+
+	// Make sure that the result can be loaded.
+	if _, err := parseKeymap(result); err != nil {
+		return nil, nil, err
+	}
+	return result, imp.notes, nil
+}
+
+// Import a QMK keymap for "control import-qmk keymap.json". The keymap is
+// written to standard output and the notes to standard error. Return the exit
+// status for the process.
+func runImportQMK(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: control import-qmk keymap.json")
+		return 2
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	result, notes, err := importQMK(data, *c.Geometry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	os.Stdout.Write(append(result, '\n'))
+	for _, value := range notes {
+		fmt.Fprintln(os.Stderr, value)
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Request a reload without blocking. The channel is buffered so that multiple
+// requests made while a reload is pending are merged into one.
+func requestReload(reloadChan chan bool) {
+	select {
+	case reloadChan <- true:
+	default:
+	}
+}
+
+// Request a reload when the process receives SIGHUP or when the keymap or the
+// device configuration file is written. The directories are watched rather
+// than the files since editors often replace a file instead of writing to it.
+func watchReload(reloadChan chan bool) error {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	go func() {
+		for range sigChan {
+			requestReload(reloadChan)
+		}
+	}()
+
+	fd, err := syscall.InotifyInit()
+	if err != nil {
+		return err
+	}
+	dirs := make(map[int32]string)
+	files := make(map[string]bool)
+	for _, value := range []string{*keymapPath, *configPath} {
+		dir := filepath.Dir(value)
+		wd, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO)
+		if err != nil {
+			return err
+		}
+		dirs[int32(wd)] = dir
+		files[filepath.Clean(value)] = true
+	}
+
+	go func() {
+		data := make([]byte, 256*syscall.SizeofInotifyEvent)
+		for {
+			n, err := syscall.Read(fd, data)
+			if err != nil {
+				log.Print(err)
+				return
+			}
+
+			// Parse events the same way as handleInput() does for /dev.
+			for i := 0; i < n; {
+				wd := int32(binary.LittleEndian.Uint32(data[i : i+4]))
+				end := i + syscall.SizeofInotifyEvent
+				size := int(binary.LittleEndian.Uint32(data[end-4 : end]))
+				i = end + size
+				file := strings.TrimRight(string(data[end:i]), "\x00")
+				if files[filepath.Join(dirs[wd], file)] {
+					requestReload(reloadChan)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Apply the keymap and device configuration from disk. If either fails to load
+// or validate, log the error and keep the running configuration. The current
+// device, layer, and modifiers are kept where they remain valid.
+func (s *state) reload() {
+	km, c, err := loadSettings()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	d, err := newDevices(c)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	// Release every held key and modifier through the current writer if the
+	// current device is removed or its writer changes, such as when its MAC
+	// address changes, so that nothing stays pressed on its host. Treat every
+	// key as released if the number of positions changes.
+	next, kept := d[s.device]
+	if !kept || next.writer != devices[s.device].writer {
+		s.releaseAll()
+		for key, value := range s.modifiers {
+			if value {
+				s.releaseModifier(key)
+			}
+		}
+	}
+	if n := c.Geometry.size(); len(s.keys) != n {
+		s.releaseAll()
+		s.keys, s.held = make([]bool, n), make([]func(), n)
+	}
+
+	useKeymap(km)
+	board, devices = *c.Geometry, d
+	leftMAC, rightMAC, defaultDevice = c.Left, c.Right, c.Default
+
+	// Switch to the new default device if the current device was removed and
+	// forget the state of removed devices. Reset the layers if any active
+	// layer no longer exists.
+	if !kept {
+		switchKey(c.Default).handle(s)
+	}
+	for name := range s.saved {
+		if _, ok := d[name]; !ok {
+			delete(s.saved, name)
+		}
+	}
+	if !s.layer.valid(len(s.keymapLayers())) {
+		s.layer = layerState{}
+	}
+	retireWriters(d)
+	log.Print("reloaded configuration")
+}
@@ -1,5 +1,9 @@
 set -e
 
+# This is only needed when the code changes. The running control process
+# reloads keymap.json and config.json on its own when they are written or on
+# SIGHUP.
+
 o="/root/bin/control-$(date +'%Y%m%d-%H%M%S')"
 go build -o $o control
 
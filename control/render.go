@@ -0,0 +1,413 @@
+package main
+
+// #include "keycode.h"
+import "C"
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Define the width of each key in characters for the terminal table and in
+// pixels for the SVG diagram.
+const (
+	cellWidth = 5
+	svgKey    = 48
+	svgGap    = 4
+)
+
+// Define legends for keyboard page usages. Usages that are not listed use the
+// keycode.h name without the KC_ prefix.
+var desktopLegends = map[uint8]string{
+	C.KC_ENTER:       "Enter",
+	C.KC_ESCAPE:      "Esc",
+	C.KC_BSPACE:      "Bksp",
+	C.KC_TAB:         "Tab",
+	C.KC_SPACE:       "Space",
+	C.KC_MINUS:       "-",
+	C.KC_EQUAL:       "=",
+	C.KC_LBRACKET:    "[",
+	C.KC_RBRACKET:    "]",
+	C.KC_BSLASH:      "\\",
+	C.KC_SCOLON:      ";",
+	C.KC_QUOTE:       "'",
+	C.KC_GRAVE:       "`",
+	C.KC_COMMA:       ",",
+	C.KC_DOT:         ".",
+	C.KC_SLASH:       "/",
+	C.KC_CAPSLOCK:    "Caps",
+	C.KC_PSCREEN:     "PrtSc",
+	C.KC_INSERT:      "Ins",
+	C.KC_HOME:        "Home",
+	C.KC_PGUP:        "PgUp",
+	C.KC_DELETE:      "Del",
+	C.KC_END:         "End",
+	C.KC_PGDOWN:      "PgDn",
+	C.KC_RIGHT:       "→",
+	C.KC_LEFT:        "←",
+	C.KC_DOWN:        "↓",
+	C.KC_UP:          "↑",
+	C.KC_APPLICATION: "App",
+	C.KC_LCTRL:       "Ctrl",
+	C.KC_LSHIFT:      "Shift",
+	C.KC_LALT:        "Alt",
+	C.KC_LGUI:        "GUI",
+	C.KC_RCTRL:       "Ctrl",
+	C.KC_RSHIFT:      "Shift",
+	C.KC_RALT:        "AltGr",
+	C.KC_RGUI:        "GUI",
+}
+
+// Define symbols for modifiers that are part of a chord.
+var modifierLegends = [8]string{"⌃", "⇧", "⌥", "◆", "⌃", "⇧", "⌥", "◆"}
+
+// Define legends for consumer page usages used by the keymap.
+var consumerLegends = map[consumerKey]string{
+	0xe2: "Mute",
+	0xe9: "Vol+",
+	0xea: "Vol-",
+}
+
+// Define prefixes for the legends of layer keys.
+var layerLegends = map[layerMode]string{
+	layerTo:        "L",
+	layerOSL:       "OSL",
+	layerMomentary: "MO",
+	layerToggle:    "TG",
+	layerDefault:   "DF",
+}
+
+// Define legends for compiled keys whose structure does not describe them well.
+var namedLegends = map[string]string{
+	"kcNone":       "✕",
+	"kcLeader":     "Lead",
+	"kcCapsWord":   "CapsW",
+	"kcASUp":       "AS↑",
+	"kcASDown":     "AS↓",
+	"kcASToggle":   "ASTg",
+	"kcASReport":   "ASRp",
+	"kcMsBtn1":     "Btn1",
+	"kcMsBtn2":     "Btn2",
+	"kcMsBtn3":     "Btn3",
+	"kcMsUp":       "M↑",
+	"kcMsDown":     "M↓",
+	"kcMsLeft":     "M←",
+	"kcMsRight":    "M→",
+	"kcWhUp":       "W↑",
+	"kcWhDown":     "W↓",
+	"kcFnModLock":  "Lock",
+	"kcFnTmpReset": "TmpRs",
+	"kcFnPowerOff": "Off",
+	"kcFnReboot":   "Boot",
+	"kcSelWordL":   "SelW←",
+	"kcDelWord":    "DelW",
+	"kcLockScrn":   "LkScr",
+	"kcSwitchApp":  "AppSw",
+	"kcNewTab":     "NTab",
+	"kcScrnShot":   "Shot",
+	"kcFFMenu":     "FFMnu",
+	"kcATilde":     "á",
+	"kcETilde":     "é",
+	"kcITilde":     "í",
+	"kcOTilde":     "ó",
+	"kcUTilde":     "ú",
+	"kcNTilde":     "ñ",
+	"kcUDier":      "ü",
+	"kcExclInv":    "¡",
+	"kcQuesInv":    "¿",
+}
+
+// Find the name of a compiled key. Function keys are compared by address since
+// functions are otherwise never equal.
+func keyName(k key) (string, bool) {
+	names := make([]string, 0, len(keyNames))
+	for name := range keyNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := keyNames[name]
+		if f, ok := k.(funcKey); ok {
+			if g, ok := value.(funcKey); ok && reflect.ValueOf(f).Pointer() == reflect.ValueOf(g).Pointer() {
+				return name, true
+			}
+		} else if reflect.DeepEqual(k, value) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func desktopLegend(code uint8) string {
+	if legend, ok := desktopLegends[code]; ok {
+		return legend
+	}
+	if name := keycodeName(code); name != "" {
+		// Show letters in lower case since shifted letters are upper case.
+		name = strings.TrimPrefix(name, "KC_")
+		if len(name) == 1 {
+			name = strings.ToLower(name)
+		}
+		return name
+	}
+	return fmt.Sprintf("0x%02x", code)
+}
+
+// Describe a key in a few characters.
+func legend(k key) string {
+	if k == nil {
+		return ""
+	}
+	if name, ok := keyName(k); ok {
+		if legend, ok := namedLegends[name]; ok {
+			return legend
+		}
+	}
+
+	switch k := k.(type) {
+	case desktopKey:
+		return desktopLegend(k.code)
+	case consumerKey:
+		if legend, ok := consumerLegends[k]; ok {
+			return legend
+		}
+		return fmt.Sprintf("C%03x", uint16(k))
+	case layerKey:
+		return fmt.Sprintf("%s%d", layerLegends[k.mode], k.layer)
+	case switchKey:
+		return "→" + strings.ToUpper(strings.TrimRight(string(k), "0123456789"))
+	case mouseKey:
+		return "Mouse"
+	case macroKey:
+		switch k.op {
+		case macroRecord:
+			return fmt.Sprintf("Rec%d", k.slot)
+		case macroPlay:
+			return fmt.Sprintf("Play%d", k.slot)
+		}
+		return "Stop"
+	case funcKey:
+		return "Fn"
+	case commandKey:
+		return k.cmd
+	case intlKey:
+		return legend(k.stdKey)
+	case tapHoldKey:
+		return legend(k.tap) + "/" + legend(k.hold)
+	case tapDanceKey:
+		legends := make([]string, len(k.taps))
+		for key, value := range k.taps {
+			legends[key] = legend(value)
+		}
+		return strings.Join(legends, "")
+	case unicodeKey:
+		return string(k)
+	case composeKey:
+		return string(k)
+	case shortcutKey:
+		// Show the action with an initial capital, as in Copy.
+		return strings.ToUpper(string(k[:1])) + string(k[1:])
+	case unicodeCompoundKey:
+		runes := make([]rune, len(k))
+		for key, value := range k {
+			runes[key] = rune(value)
+		}
+		return strings.Join(strings.Split(string(runes), ""), "‍")
+	case stringKey:
+		return `"` + string(k) + `"`
+	case virtualKey:
+		// Describe modifiers followed by a single key as a chord. Shifted
+		// letters are shown in upper case.
+		var mods string
+		for key, value := range k {
+			d, ok := value.(desktopKey)
+			if !ok {
+				break
+			}
+			if key == len(k)-1 {
+				base := desktopLegend(d.code)
+				if mods == "⇧" && len(base) == 1 && base >= "a" && base <= "z" {
+					return strings.ToUpper(base)
+				}
+				return mods + base
+			}
+			if !isModifier(d.code) {
+				break
+			}
+			mods += modifierLegends[getModifierIndex(d.code)]
+		}
+
+		legends := make([]string, len(k))
+		for key, value := range k {
+			legends[key] = legend(value)
+		}
+		return strings.Join(legends, " ")
+	}
+	return "?"
+}
+
+// Estimate the number of terminal columns used by s. Emoji and other wide
+// characters use two columns and joiners and variation selectors use none.
+func displayWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		switch {
+		case r == 0x200d || (r >= 0xfe00 && r <= 0xfe0f):
+		case r >= 0x1f000 || (r >= 0x2e80 && r <= 0xa4cf) || (r >= 0xac00 && r <= 0xd7a3):
+			n += 2
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// Fit a legend in a cell, truncating it if necessary.
+func fitCell(s string) string {
+	if displayWidth(s) > cellWidth {
+		runes := []rune(s)
+		for displayWidth(string(runes))+1 > cellWidth {
+			runes = runes[:len(runes)-1]
+		}
+		s = string(runes) + "…"
+	}
+	pad := cellWidth - displayWidth(s)
+	return strings.Repeat(" ", pad/2) + s + strings.Repeat(" ", pad-pad/2)
+}
+
+// Compute the grids of both halves with positions relative to the start of
+// the layer. Both grids have the same number of rows, with rows added to the
+// top of the shorter half so that the thumb clusters in the last row line up.
+func boardGrids(g geometry) [2][][]int {
+	grids := [2][][]int{g.Left.grid(), g.Right.grid()}
+	for _, row := range grids[1] {
+		for key, value := range row {
+			if value >= 0 {
+				row[key] += g.Left.size()
+			}
+		}
+	}
+	for key, value := range grids {
+		other := grids[1-key]
+		for len(value) < len(other) {
+			value = append([][]int{make([]int, len(value[0]))}, value...)
+			for k := range value[0] {
+				value[0][k] = -1
+			}
+		}
+		grids[key] = value
+	}
+	return grids
+}
+
+// Write each layer as a table with the two halves side by side. The thumb
+// cluster in the last row is separated from the rest of the board and
+// positions without a switch are shaded.
+func renderASCII(w io.Writer, l []layer, g geometry) {
+	grids := boardGrids(g)
+	rows := len(grids[0])
+	var borders [2]string
+	for key, value := range grids {
+		borders[key] = strings.Repeat("+"+strings.Repeat("-", cellWidth), len(value[0])) + "+"
+	}
+	border := borders[0] + "   " + borders[1]
+	for i, value := range l {
+		fmt.Fprintf(w, "Layer %d\n", i)
+		for j := 0; j < rows; j++ {
+			if j == rows-1 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintln(w, border)
+			for half, grid := range grids {
+				if half == 1 {
+					fmt.Fprint(w, "   ")
+				}
+				for _, p := range grid[j] {
+					if p < 0 {
+						fmt.Fprint(w, "|"+strings.Repeat("░", cellWidth))
+					} else {
+						fmt.Fprint(w, "|"+fitCell(legend(value[p])))
+					}
+				}
+				fmt.Fprint(w, "|")
+			}
+			fmt.Fprintln(w)
+			if j >= rows-2 {
+				fmt.Fprintln(w, border)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// Write every layer as a standalone SVG document with one diagram per layer.
+func renderSVG(w io.Writer, l []layer, g geometry) {
+	grids := boardGrids(g)
+	rows := len(grids[0])
+	step := svgKey + svgGap
+	halfWidth := len(grids[0][0]) * step
+	boardWidth := halfWidth + len(grids[1][0])*step + 2*step
+	boardHeight := (rows+1)*step + step/2
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"sans-serif\" font-size=\"12\">\n",
+		boardWidth+2*svgGap, len(l)*boardHeight+svgGap)
+	for i, value := range l {
+		y0 := i*boardHeight + svgGap
+		fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" font-size=\"16\">Layer %d</text>\n", svgGap, y0+16, i)
+		for half, grid := range grids {
+			x0 := svgGap + half*(halfWidth+2*step)
+			for j, row := range grid {
+				// Leave a gap above the thumb cluster.
+				y := y0 + step/2 + j*step
+				if j == rows-1 {
+					y += step / 2
+				}
+				for col, p := range row {
+					x := x0 + col*step
+					if p < 0 {
+						fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" rx=\"4\" fill=\"none\" stroke=\"#ccc\" stroke-dasharray=\"4\"/>\n",
+							x, y, svgKey, svgKey)
+						continue
+					}
+					fill := "#fff"
+					if value[p] == nil {
+						fill = "#eee"
+					}
+					fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" rx=\"4\" fill=\"%s\" stroke=\"#333\"/>\n",
+						x, y, svgKey, svgKey, fill)
+					fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" text-anchor=\"middle\">%s</text>\n",
+						x+svgKey/2, y+svgKey/2+4, html.EscapeString(legend(value[p])))
+				}
+			}
+		}
+	}
+	fmt.Fprintln(w, "</svg>")
+}
+
+// Render the keymap for "control render [ascii|svg]". Return the exit status
+// for the process.
+func runRender(args []string) int {
+	km, c, err := loadSettings()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	format := "ascii"
+	if len(args) > 0 {
+		format = args[0]
+	}
+	switch format {
+	case "ascii":
+		renderASCII(os.Stdout, km.layers, *c.Geometry)
+	case "svg":
+		renderSVG(os.Stdout, km.layers, *c.Geometry)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", format)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,66 @@
+package main
+
+// Define key type for a named action, such as copy, that is typed with the
+// chord of the platform of the device.
+type shortcutKey string
+
+// Map each action to its chord on each platform. Platforms that do not have a
+// chord for an action treat it as a no-op.
+var shortcuts = map[shortcutKey]map[platform]key{
+	"copy":  ctrlOrCmd(kcCLower),
+	"paste": ctrlOrCmd(kcVLower),
+	"undo":  ctrlOrCmd(kcZLower),
+	"redo": {
+		platAndroid: virtualKey{kcLCtrl, kcLShift, kcZLower},
+		platLinux:   virtualKey{kcLCtrl, kcLShift, kcZLower},
+		platMacOS:   virtualKey{kcLGUI, kcLShift, kcZLower},
+		platWindows: virtualKey{kcLCtrl, kcYLower},
+	},
+	"select-word-left": ctrlOrOption(kcLShift, kcLeft),
+	"delete-word":      ctrlOrOption(kcBspace),
+	"lock-screen": {
+		platLinux:   virtualKey{kcLGUI, kcLLower},
+		platMacOS:   virtualKey{kcLCtrl, kcLGUI, kcQLower},
+		platWindows: virtualKey{kcLGUI, kcLLower},
+	},
+	"switch-app": {
+		platAndroid: virtualKey{kcLAlt, kcTab},
+		platLinux:   virtualKey{kcLAlt, kcTab},
+		platMacOS:   virtualKey{kcLGUI, kcTab},
+		platWindows: virtualKey{kcLAlt, kcTab},
+	},
+	"new-tab": ctrlOrCmd(kcTLower),
+	"screenshot": {
+		platAndroid: kcPrtScn,
+		platLinux:   kcPrtScn,
+		platMacOS:   virtualKey{kcLGUI, kcLShift, kc3},
+		platWindows: virtualKey{kcLGUI, kcPrtScn},
+	},
+}
+
+// Get chords that hold Command on MacOS and Ctrl on every other platform.
+func ctrlOrCmd(keys ...key) map[platform]key {
+	return chords(kcLCtrl, kcLGUI, keys)
+}
+
+// Get chords that hold Option on MacOS and Ctrl on every other platform.
+func ctrlOrOption(keys ...key) map[platform]key {
+	return chords(kcLCtrl, kcLAlt, keys)
+}
+
+func chords(std, mac key, keys []key) map[platform]key {
+	return map[platform]key{
+		platAndroid: append(virtualKey{std}, keys...),
+		platLinux:   append(virtualKey{std}, keys...),
+		platMacOS:   append(virtualKey{mac}, keys...),
+		platWindows: append(virtualKey{std}, keys...),
+	}
+}
+
+func (k shortcutKey) handle(s *state) {
+	if chord := shortcuts[k][devices[s.device].platform]; chord != nil {
+		chord.handle(s)
+	} else {
+		s.handleKey(0)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import "time"
+
+// Define a tap dance key that has been pressed but not yet resolved. Count is
+// the number of presses so far and at is the time of the last press or
+// release of the key.
+type pendingTapDance struct {
+	pos   int
+	key   tapDanceKey
+	count int
+	down  bool
+	at    time.Time
+}
+
+// Get the action for n taps, or nil if there is none.
+func (k tapDanceKey) tap(n int) key {
+	if n <= len(k.taps) {
+		return k.taps[n-1]
+	}
+	return nil
+}
+
+// Get the action for holding the key on the nth press, or nil if there is none.
+func (k tapDanceKey) hold(n int) key {
+	if n <= len(k.holds) {
+		return k.holds[n-1]
+	}
+	return nil
+}
+
+// Get the number of presses after which no other action is possible.
+func (k tapDanceKey) maxTaps() int {
+	if len(k.holds) > len(k.taps) {
+		return len(k.holds)
+	}
+	return len(k.taps)
+}
+
+// Count queued presses and releases of the pending tap dance key. Decide the
+// action once the key is not pressed again within the tapping term, once it is
+// pressed as many times as it has actions for, or once another key is pressed.
+// The key counts as held if it is held past the tapping term and there is a
+// hold action for the number of presses. Return false if it cannot be decided
+// yet.
+func (s *state) resolveTapDance(now time.Time) bool {
+	p := s.tapDance
+	for {
+		if p.count >= p.key.maxTaps() && (!p.down || p.key.hold(p.count) == nil) {
+			s.finishTapDance(false)
+			return true
+		}
+		if len(s.queue) == 0 {
+			break
+		}
+		ev := s.queue[0]
+		if ev.pos != p.pos && ev.down {
+			// Another key interrupts the dance, which ends with the taps so
+			// far.
+			s.finishTapDance(false)
+			return true
+		}
+		if !ev.at.Before(p.at.Add(tapping.term())) {
+			break
+		}
+		if ev.pos != p.pos {
+			// Releases of other keys do not affect the dance.
+			s.queue = s.queue[1:]
+			s.releasePosition(ev.pos)
+			continue
+		}
+		s.queue = s.queue[1:]
+		p.down, p.at = ev.down, ev.at
+		if ev.down {
+			p.count++
+		}
+	}
+	if now.Before(p.at.Add(tapping.term())) {
+		return false
+	}
+	s.finishTapDance(p.down && p.key.hold(p.count) != nil)
+	return true
+}
+
+// Press the action of the pending tap dance key. If the key is still down, its
+// action is released along with the key.
+func (s *state) finishTapDance(hold bool) {
+	p := s.tapDance
+	s.tapDance, s.at = nil, p.at
+	if hold {
+		s.activateHold(p.pos, p.key.hold(p.count))
+		return
+	}
+	s.activateKey(p.pos, p.key.tap(p.count))
+	if !p.down {
+		s.releasePosition(p.pos)
+	}
+}
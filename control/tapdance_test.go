@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTapDance(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []testEvent
+		want   string
+	}{
+		{
+			name:   "single tap",
+			events: []testEvent{press(0, 0), release(50, 0), tick(250)},
+			want:   "+KC_A -KC_A",
+		},
+		{
+			name:   "double tap",
+			events: []testEvent{press(0, 0), release(50, 0), press(100, 0), release(150, 0), tick(350)},
+			want:   "+KC_B -KC_B",
+		},
+		{
+			name:   "last tap",
+			events: []testEvent{press(0, 0), release(50, 0), press(100, 0), release(150, 0), press(200, 0), release(250, 0)},
+			want:   "+KC_C -KC_C",
+		},
+		{
+			name:   "hold",
+			events: []testEvent{press(0, 0), tick(200), release(300, 0)},
+			want:   "+KC_LSHIFT -KC_LSHIFT",
+		},
+		{
+			name:   "held without hold action",
+			events: []testEvent{press(0, 0), release(50, 0), press(100, 0), tick(300), release(400, 0)},
+			want:   "+KC_B -KC_B",
+		},
+		{
+			name:   "interrupted",
+			events: []testEvent{press(0, 0), release(50, 0), press(100, 1), release(110, 1)},
+			want:   "+KC_A -KC_A +KC_D -KC_D",
+		},
+		{
+			name:   "interrupted while held",
+			events: []testEvent{press(0, 0), press(50, 1), release(60, 1), release(100, 0)},
+			want:   "+KC_A +KC_D -KC_D -KC_A",
+		},
+		{
+			name:   "taps after term",
+			events: []testEvent{press(0, 0), release(50, 0), press(300, 0), release(350, 0), tick(600)},
+			want:   "+KC_A -KC_A +KC_A -KC_A",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, log := newTestState(layer{
+				tapDanceKey{taps: []key{kcALower, kcBLower, kcCLower}, holds: []key{kcLShift}},
+				kcDLower,
+			})
+			if got := runEvents(s, log, tt.events); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test that the hold action of a tap dance key is handled like any other key
+// that is pressed, as a key of a leader sequence or of a word in caps.
+func TestTapDanceHoldAction(t *testing.T) {
+	s, log := newTestState(layer{tapDanceKey{taps: []key{kcALower}, holds: []key{kcMinus}}})
+	s.capsWord = true
+	got := runEvents(s, log, []testEvent{press(0, 0), tick(200), release(300, 0)})
+	if want := "+KC_LSHIFT +KC_MINUS -KC_MINUS -KC_LSHIFT"; got != want {
+		t.Errorf("caps word: got %q, want %q", got, want)
+	}
+
+	s, log = newTestState(layer{tapDanceKey{taps: []key{kcALower}, holds: []key{kcMinus}}})
+	leader.sequences = []leaderSequence{{codes: []uint8{kcMinus.code}, key: kcEscape}}
+	s.sequence = &pendingSequence{deadline: time.Unix(0, 0).Add(time.Hour)}
+	got = runEvents(s, log, []testEvent{press(0, 0), tick(200), release(300, 0)})
+	if want := "+KC_ESCAPE -KC_ESCAPE"; got != want {
+		t.Errorf("leader: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import "time"
+
+// Define tap-hold behavior. Term is the tapping term in milliseconds. A
+// tap-hold key that is released within the term is a tap and one that is held
+// past the term is a hold. If PermissiveHold is set, pressing and releasing
+// another key while the tap-hold key is held is a hold. If HoldOnOtherKeyPress
+// is set, pressing any other key while it is held is a hold. These match the
+// QMK options of the same names.
+type tappingConfig struct {
+	Term                int  `json:"term"`
+	PermissiveHold      bool `json:"permissiveHold"`
+	HoldOnOtherKeyPress bool `json:"holdOnOtherKeyPress"`
+}
+
+var defaultTapping = tappingConfig{Term: 200}
+
+// Define a tap-hold key that has been pressed but not yet resolved. Events
+// that follow it are queued until it is resolved.
+type pendingTapHold struct {
+	pos int
+	key tapHoldKey
+	at  time.Time
+}
+
+func (c tappingConfig) term() time.Duration {
+	return time.Duration(c.Term) * time.Millisecond
+}
+
+// Decide whether the pending tap-hold key is a hold based on the queued events
+// and the current time. Return false for ok if it cannot be decided yet.
+func (s *state) resolveTapHold(now time.Time) (hold, ok bool) {
+	p := s.tapHold
+	deadline := p.at.Add(tapping.term())
+	pressed := make(map[int]bool)
+	for _, ev := range s.queue {
+		switch {
+		case !ev.at.Before(deadline):
+			return true, true
+		case ev.pos == p.pos && !ev.down:
+			return false, true
+		case ev.down && tapping.HoldOnOtherKeyPress:
+			return true, true
+		case ev.down:
+			pressed[ev.pos] = true
+		case pressed[ev.pos] && tapping.PermissiveHold:
+			return true, true
+		}
+	}
+	if !now.Before(deadline) {
+		return true, true
+	}
+	return false, false
+}
+
+// Hold a key for as long as a tap-hold key is held. Modifiers are held instead
+// of toggled and layer keys activate the layer until released.
+func (s *state) holdAction(k key) func() {
+	switch k := k.(type) {
+	case desktopKey:
+		if code := k.code; isModifier(code) {
+			// Lock the modifier so that it is not released by other keys.
+			i := getModifierIndex(code)
+			s.output().pressDesktop(code)
+			s.modifiers[i], s.modLocks[i] = true, true
+			return func() {
+				if s.modifiers[i] {
+					s.releaseModifier(int(i))
+				}
+			}
+		}
+	case virtualKey:
+		// Hold every modifier of a chord of modifiers such as Meh.
+		var releases []func()
+		for _, value := range k {
+			d, ok := value.(desktopKey)
+			if !ok || !isModifier(d.code) {
+				releases = nil
+				break
+			}
+			releases = append(releases, s.holdAction(d))
+		}
+		if releases != nil {
+			return func() {
+				for _, release := range releases {
+					release()
+				}
+			}
+		}
+	case layerKey:
+		return layerKey{layer: k.layer, mode: layerMomentary}.press(s)
+	}
+	return s.pressKey(k)
+}
@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestTapHold(t *testing.T) {
+	permissive := tappingConfig{Term: 200, PermissiveHold: true}
+	eager := tappingConfig{Term: 200, HoldOnOtherKeyPress: true}
+	tests := []struct {
+		name    string
+		tapping tappingConfig
+		events  []testEvent
+		want    string
+	}{
+		{
+			name:   "tap",
+			events: []testEvent{press(0, 0), release(100, 0)},
+			want:   "+KC_A -KC_A",
+		},
+		{
+			name:   "hold past term",
+			events: []testEvent{press(0, 0), tick(200), release(300, 0)},
+			want:   "+KC_LSHIFT -KC_LSHIFT",
+		},
+		{
+			name:   "released at term",
+			events: []testEvent{press(0, 0), release(200, 0)},
+			want:   "+KC_LSHIFT -KC_LSHIFT",
+		},
+		{
+			name:   "key after term",
+			events: []testEvent{press(0, 0), press(250, 1), release(260, 1), release(300, 0)},
+			want:   "+KC_LSHIFT +KC_B -KC_B -KC_LSHIFT",
+		},
+		{
+			name:   "roll",
+			events: []testEvent{press(0, 0), press(50, 1), release(100, 0), release(150, 1)},
+			want:   "+KC_A +KC_B -KC_A -KC_B",
+		},
+		{
+			name:   "nested",
+			events: []testEvent{press(0, 0), press(50, 1), release(100, 1), release(150, 0)},
+			want:   "+KC_A +KC_B -KC_B -KC_A",
+		},
+		{
+			name:    "permissive hold nested",
+			tapping: permissive,
+			events:  []testEvent{press(0, 0), press(50, 1), release(100, 1), release(150, 0)},
+			want:    "+KC_LSHIFT +KC_B -KC_B -KC_LSHIFT",
+		},
+		{
+			name:    "permissive hold roll",
+			tapping: permissive,
+			events:  []testEvent{press(0, 0), press(50, 1), release(100, 0), release(150, 1)},
+			want:    "+KC_A +KC_B -KC_A -KC_B",
+		},
+		{
+			name:    "hold on other key press",
+			tapping: eager,
+			events:  []testEvent{press(0, 0), press(50, 1), release(100, 0), release(150, 1)},
+			want:    "+KC_LSHIFT +KC_B -KC_LSHIFT -KC_B",
+		},
+		{
+			name:   "layer tap held",
+			events: []testEvent{press(0, 2), press(250, 1), release(260, 1), release(300, 2)},
+			want:   "+KC_C -KC_C",
+		},
+		{
+			name:   "layer tap tapped",
+			events: []testEvent{press(0, 2), release(50, 2), press(100, 1), release(110, 1)},
+			want:   "+KC_D -KC_D +KC_B -KC_B",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, log := newTestState(
+				layer{keyMT(kcLShift, kcALower), kcBLower, keyLT(1, kcDLower)},
+				layer{nil, kcCLower, nil},
+			)
+			if tt.tapping.Term != 0 {
+				tapping = tt.tapping
+			}
+			if got := runEvents(s, log, tt.events); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
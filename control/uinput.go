@@ -16,7 +16,7 @@ void _write_event(int fd, int type, int code, int val) {
 	int n = write(fd, &ev, sizeof(ev));
 }
 
-void _set_keybit(int fd, unsigned char ev) {
+void _set_keybit(int fd, int ev) {
 	ioctl(fd, UI_SET_KEYBIT, ev);
 }
 
@@ -25,6 +25,15 @@ void _set_keybit(int fd, unsigned char ev) {
 void _init_uinput(int fd) {
 	struct uinput_setup usetup;
 	ioctl(fd, UI_SET_EVBIT, EV_KEY);
+
+	// Enable relative movement for mouse keys.
+	ioctl(fd, UI_SET_EVBIT, EV_REL);
+	ioctl(fd, UI_SET_RELBIT, REL_X);
+	ioctl(fd, UI_SET_RELBIT, REL_Y);
+	ioctl(fd, UI_SET_RELBIT, REL_WHEEL);
+
+	// Enable autorepeat in the kernel for keys that are held.
+	ioctl(fd, UI_SET_EVBIT, EV_REP);
 	memset(&usetup, 0, sizeof(usetup));
 	usetup.id.bustype = BUS_USB;
 	usetup.id.vendor = 0x1d6b;
@@ -39,10 +48,15 @@ import "C"
 
 import "os"
 
+// Map mouse buttons in the order of the HID mouse report to input event codes.
+var uinputButtons = []C.int{C.BTN_LEFT, C.BTN_RIGHT, C.BTN_MIDDLE, C.BTN_SIDE, C.BTN_EXTRA}
+
 // Use uinput to use the keyboard with the controller itself. This code is based
-// on https://goo.gl/XyNyhr.
+// on https://goo.gl/XyNyhr. Since input events describe changes, the mouse
+// buttons that are held are tracked.
 type uinputWriter struct {
-	fd C.int
+	fd      C.int
+	buttons *uint8
 }
 
 func (w uinputWriter) write(key uint8, value C.int) {
@@ -62,8 +76,26 @@ func (w uinputWriter) releaseDesktop(key uint8) {
 
 func (w uinputWriter) sendConsumer(key uint16) {}
 
+func (w uinputWriter) sendMouse(buttons uint8, x, y, wheel int8) {
+	for key, value := range uinputButtons {
+		if bit := uint8(1) << uint(key); (buttons^*w.buttons)&bit != 0 {
+			C._write_event(w.fd, C.EV_KEY, value, C.int(buttons&bit>>uint(key)))
+		}
+	}
+	*w.buttons = buttons
+	for _, value := range []struct {
+		code  C.int
+		delta int8
+	}{{C.REL_X, x}, {C.REL_Y, y}, {C.REL_WHEEL, wheel}} {
+		if value.delta != 0 {
+			C._write_event(w.fd, C.EV_REL, value.code, C.int(value.delta))
+		}
+	}
+	C._write_event(w.fd, C.EV_SYN, C.SYN_REPORT, 0)
+}
+
 func newUinputWriter() (uinputWriter, error) {
-	var w uinputWriter
+	w := uinputWriter{buttons: new(uint8)}
 
 	f, err := os.OpenFile("/dev/uinput", os.O_WRONLY, 0666)
 	if err != nil {
@@ -73,9 +105,12 @@ func newUinputWriter() (uinputWriter, error) {
 
 	for _, value := range C.usb_kbd_keycode {
 		if value != 0 {
-			C._set_keybit(w.fd, value)
+			C._set_keybit(w.fd, C.int(value))
 		}
 	}
+	for _, value := range uinputButtons {
+		C._set_keybit(w.fd, value)
+	}
 	C._init_uinput(w.fd)
 
 	return w, nil
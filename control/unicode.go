@@ -0,0 +1,120 @@
+package main
+
+// #include "keycode.h"
+import "C"
+
+import (
+	"fmt"
+	"unicode/utf16"
+)
+
+type unicodeMethod int
+
+// Define how Unicode characters are entered on the host. These match the QMK
+// input modes of similar names. See https://docs.qmk.fm/#/feature_unicode for
+// what each requires of the host.
+const (
+	// Ignore Unicode characters.
+	unicodeNone unicodeMethod = iota
+
+	// Type Ctrl-Shift-U followed by the code point in hex and a space, which
+	// is supported by IBus on Linux.
+	unicodeLinux
+
+	// Hold Option while typing each UTF-16 code unit as 4 hex digits, which
+	// requires the Unicode Hex Input source on MacOS. Characters above U+FFFF
+	// are typed as surrogate pairs.
+	unicodeMacOS
+
+	// Tap the compose key, which is Right Alt by default, then type u followed
+	// by the code point in hex and Enter, which requires WinCompose on
+	// Windows.
+	unicodeWinCompose
+
+	// Hold Alt while typing plus on the number pad and the code point in hex,
+	// which requires the EnableHexNumpad registry setting on Windows. Only
+	// characters up to U+FFFF can be typed.
+	unicodeAltNumpad
+)
+
+var unicodeMethods = map[string]unicodeMethod{
+	"none":       unicodeNone,
+	"linux":      unicodeLinux,
+	"macos":      unicodeMacOS,
+	"wincompose": unicodeWinCompose,
+	"altnumpad":  unicodeAltNumpad,
+}
+
+// Define the method used by each platform if the device does not set one.
+// Android has no way to enter Unicode characters from a keyboard, so Unicode
+// keys do nothing there and control check reports those that Android devices
+// can reach unless the device sets the method to none.
+var platformUnicode = map[platform]unicodeMethod{
+	platAndroid: unicodeNone,
+	platLinux:   unicodeLinux,
+	platMacOS:   unicodeMacOS,
+	platWindows: unicodeWinCompose,
+}
+
+// Map hex digits to number pad keys for the Alt method. Letters are typed with
+// the regular keys.
+var numpadDigits = [10]uint8{
+	C.KC_KP_0, C.KC_KP_1, C.KC_KP_2, C.KC_KP_3, C.KC_KP_4,
+	C.KC_KP_5, C.KC_KP_6, C.KC_KP_7, C.KC_KP_8, C.KC_KP_9,
+}
+
+// Check whether r can be typed with method m.
+func (m unicodeMethod) canInput(r rune) bool {
+	switch m {
+	case unicodeNone:
+		return false
+	case unicodeAltNumpad:
+		return r <= 0xffff
+	}
+	return true
+}
+
+// Format value in lowercase hex, padded with zeros to at least digits digits.
+func hexDigits(value int64, digits int) string {
+	return fmt.Sprintf("%0*x", digits, value)
+}
+
+// Type r using method m. Unlocked modifiers are released first so that they do
+// not apply to the sequence.
+func (m unicodeMethod) input(s *state, r rune) {
+	s.handleKey(0)
+	w := s.output()
+	switch {
+	case m == unicodeLinux:
+		virtualKey{kcLCtrl, kcLShift, kcULower}.handle(s)
+		stringKey(hexDigits(int64(r), 0)).handle(s)
+		kcSpace.handle(s)
+	case m == unicodeMacOS:
+		units := []rune{r}
+		if r > 0xffff {
+			r1, r2 := utf16.EncodeRune(r)
+			units = []rune{r1, r2}
+		}
+		w.pressDesktop(C.KC_LALT)
+		for _, value := range units {
+			stringKey(hexDigits(int64(value), 4)).handle(s)
+		}
+		w.releaseDesktop(C.KC_LALT)
+	case m == unicodeWinCompose:
+		w.pressDesktop(C.KC_RALT)
+		w.releaseDesktop(C.KC_RALT)
+		stringKey("u" + hexDigits(int64(r), 0)).handle(s)
+		kcEnter.handle(s)
+	case m == unicodeAltNumpad && r <= 0xffff:
+		w.pressDesktop(C.KC_LALT)
+		s.handleKey(C.KC_KP_PLUS)
+		for _, value := range hexDigits(int64(r), 4) {
+			if value >= '0' && value <= '9' {
+				s.handleKey(numpadDigits[value-'0'])
+			} else {
+				stringKey(value).handle(s)
+			}
+		}
+		w.releaseDesktop(C.KC_LALT)
+	}
+}